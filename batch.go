@@ -0,0 +1,111 @@
+package mc
+
+// Pipelined batches of mixed requests.
+
+// Batch queues requests of different kinds to send them in one round trip per
+// server with DoBatch. The zero value is an empty batch.
+type Batch struct {
+	ms []*msg
+}
+
+// Result is the outcome of one request of a batch. N is only set for Incr and
+// Decr.
+type Result struct {
+	CAS uint64
+	N   uint64
+	Err error
+}
+
+// Len returns the number of requests queued.
+func (b *Batch) Len() int {
+	return len(b.ms)
+}
+
+// Set queues setting a key/value pair, like Client.Set.
+func (b *Batch) Set(key, val string, flags, exp uint32, ocas uint64) {
+	b.ms = append(b.ms, &msg{
+		header: header{
+			Op:  opSet,
+			CAS: ocas,
+		},
+		iextras: []interface{}{flags, exp},
+		key:     key,
+		val:     val,
+	})
+}
+
+// Del queues deleting a key, like Client.Del.
+func (b *Batch) Del(key string) {
+	b.ms = append(b.ms, &msg{
+		header: header{
+			Op: opDelete,
+		},
+		key: key,
+	})
+}
+
+// Incr queues incrementing a counter, like Client.Incr.
+func (b *Batch) Incr(key string, delta, init uint64, exp uint32) {
+	b.incrdecr(opIncrement, key, delta, init, exp)
+}
+
+// Decr queues decrementing a counter, like Client.Decr.
+func (b *Batch) Decr(key string, delta, init uint64, exp uint32) {
+	b.incrdecr(opDecrement, key, delta, init, exp)
+}
+
+func (b *Batch) incrdecr(op opCode, key string, delta, init uint64, exp uint32) {
+	b.ms = append(b.ms, &msg{
+		header: header{
+			Op: op,
+		},
+		iextras: []interface{}{delta, init, exp},
+		key:     key,
+	})
+}
+
+// DoBatch sends all requests of b and returns their results in the order they
+// were queued. Requests are grouped by server and pipelined like GetMulti, the
+// responses are matched to them by opaque. If some servers or connections
+// fail, the first error is returned and the requests that got no response
+// have it as their Err. The batch isn't changed, so it can be sent again.
+func (c *Client) DoBatch(b *Batch) (results []Result, err error) {
+	ms := make([]*msg, len(b.ms))
+	for i, bm := range b.ms {
+		m := &msg{
+			header: header{
+				Op:  bm.Op,
+				CAS: bm.CAS,
+			},
+			iextras: bm.iextras,
+			key:     bm.key,
+			val:     bm.val,
+		}
+		if m.Op == opSet {
+			var flags uint32
+			m.val, flags = c.compress(m.val, m.iextras[0].(uint32))
+			m.iextras = []interface{}{flags, m.iextras[1]}
+		}
+		ms[i] = m
+	}
+
+	err = c.performMulti(ms)
+
+	results = make([]Result, len(ms))
+	for i, m := range ms {
+		r := &results[i]
+		if m.Magic != magicRecv {
+			r.Err = err
+			continue
+		}
+		r.Err = newError(m.ResvOrStatus)
+		if r.Err != nil {
+			continue
+		}
+		r.CAS = m.CAS
+		if m.Op == opIncrement || m.Op == opDecrement {
+			r.N, r.Err = readInt(m.val)
+		}
+	}
+	return results, err
+}
@@ -1,6 +1,7 @@
 package mc
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -23,3 +24,43 @@ func BenchmarkSet(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkGet(b *testing.B) {
+	b.StopTimer()
+	c := NewMC(mcAddr, user, pass)
+	// Lazy connection. Make sure it connects before starting benchmark.
+	_, err := c.Set("foo", "bar", 0, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	b.StartTimer()
+	defer b.StopTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _, _, err := c.Get("foo")
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkGetLarge(b *testing.B) {
+	b.StopTimer()
+	c := NewMC(mcAddr, user, pass)
+	// Lazy connection. Make sure it connects before starting benchmark.
+	_, err := c.Set("foo", strings.Repeat("bar", 10000), 0, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	b.StartTimer()
+	defer b.StopTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _, _, err := c.Get("foo")
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -3,8 +3,12 @@
 package mc
 
 import (
-	"fmt"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,11 +36,13 @@ import (
 //            ignore in this client.
 
 // Multi-Get:
-// Simply implemented using GETQ. It's used for 'pipelining' requests, where the
-// client sends many GETQ's without checking the response until the very end
-// (batching). The memcached server doesn't do anything special, it sends
+// Simply implemented using GETKQ. It's used for 'pipelining' requests, where
+// the client sends many GETKQ's without checking the response until the very
+// end (batching). The memcached server doesn't do anything special, it sends
 // response straight away, so it relies on the clients socket queuing up the
-// responses on its buffer.
+// responses on its buffer. The batch is terminated by a NOOP, as the quiet
+// variants send no response on a miss, the NOOP response tells us the server
+// has processed all requests in the batch.
 
 // Response:
 // In addition to the key, value & extras we always get back in a response the
@@ -60,10 +66,16 @@ import (
 type Client struct {
 	servers []*server
 	config  *Config
+	prefix  string // prepended to all keys, see WithPrefix
+	shard   string // routes all keys if set, see WithShard
 }
 
 // NewMC creates a new client with the default configuration. For the default
 // configuration see DefaultConfig.
+//
+// servers is a list of addresses separated by commas, semicolons or spaces.
+// An address is either host[:port], tcp://host[:port] or unix:///path for a
+// unix domain socket.
 func NewMC(servers, username, password string) *Client {
 	return NewMCwithConfig(servers, username, password, DefaultConfig())
 }
@@ -92,7 +104,60 @@ func newMockableMC(servers, username, password string, config *Config, newMcConn
 	return client
 }
 
-func (c *Client) perform(m *msg) error {
+// maxKeyLen is the longest key memcached accepts.
+const maxKeyLen = 250
+
+// check rejects requests the server would refuse anyway, saving a round trip.
+func (c *Client) check(m *msg) error {
+	if len(m.key) == 0 && !m.keyless || len(m.key) > maxKeyLen {
+		return ErrInvalidArgs
+	}
+	if c.config.MaxValueSize > 0 && len(m.val) > c.config.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// WithPrefix returns a client that prepends prefix to all keys, e.g. to keep
+// the keys of services sharing a cluster apart. Keys returned by the server
+// have the prefix stripped again. The returned client shares its servers and
+// connections with c, so calling Quit on either closes both.
+func (c *Client) WithPrefix(prefix string) *Client {
+	return &Client{
+		servers: c.servers,
+		config:  c.config,
+		prefix:  c.prefix + prefix,
+		shard:   c.shard,
+	}
+}
+
+// WithShard returns a client that picks the server for all keys by shardKey
+// instead of by the key itself, so that related keys end up on the same server
+// and e.g. a GetMulti of them takes a single round trip. The keys stored are
+// unchanged. Like with WithPrefix, the returned client shares its servers and
+// connections with c.
+func (c *Client) WithShard(shardKey string) *Client {
+	return &Client{
+		servers: c.servers,
+		config:  c.config,
+		prefix:  c.prefix,
+		shard:   shardKey,
+	}
+}
+
+func (c *Client) perform(m *msg) (err error) {
+	if observe := c.config.Observer; observe != nil {
+		start := time.Now()
+		defer func() { observe(uint8(m.Op), time.Since(start), err) }()
+	}
+
+	if m.key != "" || !m.keyless {
+		m.key = c.prefix + m.key
+	}
+	if err := c.check(m); err != nil {
+		return err
+	}
+
 	// failover on error
 	for {
 		s, err := c.getServer(m.key)
@@ -100,16 +165,52 @@ func (c *Client) perform(m *msg) error {
 			return err
 		}
 		err = s.perform(m)
-		if err != nil && err.(*Error).Status == StatusNetworkError && c.config.Failover {
+		if err == nil || err.(*Error).Status != StatusNetworkError {
+			s.succeeded()
+			return err
+		}
+
+		if threshold := c.failureThreshold(); threshold > 0 && s.failed(threshold) {
+			go c.wakeUp(s)
+		}
+		if c.config.Failover && s.down() {
 			// Failover on network errors
-			if s.changeAlive(false) {
-				go c.wakeUp(s)
-			}
 			continue
 		}
 		return err
 	}
-	return nil
+}
+
+// failureThreshold returns after how many failed requests in a row a server
+// is marked down, 0 for never.
+func (c *Client) failureThreshold() int {
+	if c.config.FailureThreshold == 0 && c.config.Failover {
+		return 1
+	}
+	return c.config.FailureThreshold
+}
+
+// DownServers returns the addresses of the servers currently marked down, see
+// Config.FailureThreshold.
+func (c *Client) DownServers() []string {
+	var down []string
+	for _, s := range c.servers {
+		if s.down() {
+			down = append(down, s.address)
+		}
+	}
+	return down
+}
+
+// ServerAddress returns the address of the server that requests for key
+// currently go to, e.g. to tell in logs which server failed a request. It
+// takes servers that are down and WithPrefix and WithShard into account.
+func (c *Client) ServerAddress(key string) (string, error) {
+	s, err := c.getServer(c.prefix + key)
+	if err != nil {
+		return "", err
+	}
+	return s.address, nil
 }
 
 func (c *Client) wakeUp(s *server) {
@@ -118,14 +219,25 @@ func (c *Client) wakeUp(s *server) {
 }
 
 func (c *Client) getServer(key string) (*server, error) {
+	if c.shard != "" {
+		key = c.prefix + c.shard
+	}
 	idx, err := c.config.Hasher.getServerIndex(key)
 	if err != nil {
 		return nil, err
 	}
 	nServers := uint(len(c.servers))
+	if !c.config.Failover {
+		// fail fast rather than wait for timeouts of a server that is down
+		s := c.servers[idx%nServers]
+		if s.down() {
+			return nil, &Error{StatusNetworkError, "Server currently down", nil}
+		}
+		return s, nil
+	}
 	for i := uint(0); i < nServers; i++ {
-		s := c.servers[idx+i%nServers]
-		if s.isAlive {
+		s := c.servers[(idx+i)%nServers]
+		if !s.down() {
 			return s, nil
 		}
 	}
@@ -137,7 +249,13 @@ func (c *Client) Get(key string) (val string, flags uint32, cas uint64, err erro
 	// Variants: [R] Get [Q, K, KQ]
 	// Request : MUST key; MUST NOT value, extras
 	// Response: MAY key, value, extras ([0..3] flags)
-	return c.getCAS(key, 0)
+	return c.getCAS(context.Background(), key, 0)
+}
+
+// GetContext retrieves a value from the cache. The request is aborted when ctx
+// is done, in which case the returned error has StatusContextError.
+func (c *Client) GetContext(ctx context.Context, key string) (val string, flags uint32, cas uint64, err error) {
+	return c.getCAS(ctx, key, 0)
 }
 
 // getCAS retrieves a value in the cache but only if the CAS specified matches
@@ -146,7 +264,7 @@ func (c *Client) Get(key string) (val string, flags uint32, cas uint64, err erro
 // NOTE: GET doesn't actually care about CAS, but we want this internally for
 // testing purposes, to be able to test that a memcache server obeys the proper
 // semantics of ignoring CAS with GETs.
-func (c *Client) getCAS(key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
+func (c *Client) getCAS(ctx context.Context, key string, ocas uint64) (val string, flags uint32, cas uint64, err error) {
 	m := &msg{
 		header: header{
 			Op:  opGet,
@@ -154,10 +272,342 @@ func (c *Client) getCAS(key string, ocas uint64) (val string, flags uint32, cas
 		},
 		oextras: []interface{}{&flags},
 		key:     key,
+		ctx:     ctx,
+	}
+
+	err = c.perform(m)
+	if err != nil {
+		return m.val, flags, m.CAS, err
+	}
+	val, flags, err = c.decompress(m.val, flags)
+	return val, flags, m.CAS, err
+}
+
+// GetStream retrieves a value from the cache as a reader over the connection,
+// instead of buffering it, e.g. to copy a large value straight to a file. size
+// is the length of the value. Compressed values aren't decompressed, check
+// flags for FlagCompressed. The request holds one of the server's connections
+// until the reader is closed, so it must always be closed, which skips what is
+// left of the value. Config.MaxResponseSize doesn't apply to the value.
+func (c *Client) GetStream(key string) (r io.ReadCloser, flags uint32, size int, err error) {
+	// Variants: [R] Get [Q, K, KQ]
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MAY key, value, extras ([0..3] flags)
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{&flags},
+		key:     c.prefix + key,
+	}
+	if err := c.check(m); err != nil {
+		return nil, 0, 0, err
+	}
+
+	s, err := c.getServer(m.key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	r, err = s.getStream(m)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size = int(m.BodyLen) - int(m.ExtraLen) - int(m.KeyLen)
+	return r, flags, size, nil
+}
+
+// GetOK retrieves a value from the cache. found is false if the key isn't in
+// the cache, err is only set for actual failures.
+func (c *Client) GetOK(key string) (val string, found bool, flags uint32, cas uint64, err error) {
+	val, flags, cas, err = c.Get(key)
+	if err == ErrNotFound {
+		return "", false, 0, 0, nil
+	}
+	return val, err == nil, flags, cas, err
+}
+
+// Exists reports whether key is in the cache. The binary protocol has no way
+// to leave out the value, so it is still transferred, but it is skipped rather
+// than buffered.
+func (c *Client) Exists(key string) (found bool, err error) {
+	// Variants: [R] Get [Q, K, KQ]
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MAY key, value, extras ([0..3] flags)
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		key:        key,
+		discardVal: true,
 	}
 
 	err = c.perform(m)
-	return m.val, flags, m.CAS, err
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Gets retrieves a value from the cache along with its CAS, to be passed to
+// CompareAndSwap to only overwrite the value if it hasn't changed since. It is
+// Get without the flags, named after the text protocol command.
+func (c *Client) Gets(key string) (val string, cas uint64, err error) {
+	val, _, cas, err = c.Get(key)
+	return val, cas, err
+}
+
+// GetInto retrieves a value from the cache into dst rather than a new string,
+// so a caller reusing dst doesn't allocate for each value. n is the length of
+// the value. If it doesn't fit into dst, nothing is copied and ErrValueTooLarge
+// is returned along with n, so dst can be grown to n and the call repeated. A
+// nil dst only looks up n, like Exists the value is still transferred but not
+// kept. With compression enabled the value is fetched and decompressed as by
+// Get, which allocates.
+func (c *Client) GetInto(key string, dst []byte) (n int, flags uint32, cas uint64, err error) {
+	if c.config.CompressThreshold > 0 {
+		val, flags, cas, err := c.Get(key)
+		if err != nil {
+			return 0, flags, cas, err
+		}
+		if dst != nil && len(val) > len(dst) {
+			return len(val), flags, cas, ErrValueTooLarge
+		}
+		copy(dst, val)
+		return len(val), flags, cas, nil
+	}
+
+	// Variants: [R] Get [Q, K, KQ]
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MAY key, value, extras ([0..3] flags)
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras:    []interface{}{&flags},
+		key:        key,
+		dst:        dst,
+		discardVal: dst == nil,
+	}
+
+	err = c.perform(m)
+	if err != nil {
+		return 0, flags, m.CAS, err
+	}
+	n = int(m.BodyLen) - int(m.ExtraLen) - int(m.KeyLen)
+	if dst != nil && n > len(dst) {
+		return n, flags, m.CAS, ErrValueTooLarge
+	}
+	return n, flags, m.CAS, nil
+}
+
+// GetBytes retrieves a value from the cache as a byte slice.
+func (c *Client) GetBytes(key string) (val []byte, flags uint32, cas uint64, err error) {
+	v, flags, cas, err := c.Get(key)
+	if err != nil {
+		return nil, flags, cas, err
+	}
+	return []byte(v), flags, cas, nil
+}
+
+// GetWithDataType retrieves a value from the cache along with its data type.
+func (c *Client) GetWithDataType(key string) (val string, flags uint32, cas uint64, dataType uint8, err error) {
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{&flags},
+		key:     key,
+	}
+
+	err = c.perform(m)
+	if err != nil {
+		return m.val, flags, m.CAS, m.DataType, err
+	}
+	val, flags, err = c.decompress(m.val, flags)
+	return val, flags, m.CAS, m.DataType, err
+}
+
+// GetK retrieves a value from the cache along with the key echoed back by the
+// server.
+func (c *Client) GetK(key string) (rkey, val string, flags uint32, cas uint64, err error) {
+	m := &msg{
+		header: header{
+			Op: opGetK,
+		},
+		oextras: []interface{}{&flags},
+		key:     key,
+	}
+
+	err = c.perform(m)
+	rkey = strings.TrimPrefix(m.key, c.prefix)
+	if err != nil {
+		return rkey, m.val, flags, m.CAS, err
+	}
+	val, flags, err = c.decompress(m.val, flags)
+	return rkey, val, flags, m.CAS, err
+}
+
+// Item is a value retrieved from the cache along with its flags and CAS.
+type Item struct {
+	Value string
+	Flags uint32
+	CAS   uint64
+}
+
+// GetMulti retrieves the values for a list of keys from the cache. The
+// requests for each server are pipelined, and run in parallel over the
+// servers and their connections. Keys that aren't in the cache are left out
+// of the returned map. If some servers or connections fail, the values that
+// were retrieved are returned along with the first error.
+func (c *Client) GetMulti(keys []string) (vals map[string]string, err error) {
+	items, err := c.GetMultiCAS(keys)
+	vals = make(map[string]string, len(items))
+	for key, item := range items {
+		vals[key] = item.Value
+	}
+	return vals, err
+}
+
+// GetMultiCAS is GetMulti returning the flags and CAS of each value as well,
+// e.g. to follow up with a CAS guarded write per key.
+func (c *Client) GetMultiCAS(keys []string) (items map[string]Item, err error) {
+	// Variants: GetKQ ... NoOp
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MUST key; MAY value, extras ([0..3] flags)
+	ms := make([]*msg, len(keys))
+	for i, key := range keys {
+		var flags uint32
+		ms[i] = &msg{
+			header: header{
+				Op: opGetKQ,
+			},
+			oextras: []interface{}{&flags},
+			key:     key,
+		}
+	}
+
+	err = c.performMulti(ms)
+
+	items = make(map[string]Item, len(keys))
+	for _, m := range ms {
+		item, found, ierr := c.item(m)
+		if ierr != nil && err == nil {
+			err = ierr
+		}
+		if found {
+			items[strings.TrimPrefix(m.key, c.prefix)] = item
+		}
+	}
+	return items, err
+}
+
+// GetMultiOrdered is GetMultiCAS returning the items in the order of keys,
+// with found[i] reporting whether keys[i] was a hit. Keys may repeat.
+func (c *Client) GetMultiOrdered(keys []string) (items []Item, found []bool, err error) {
+	// Variants: GetQ ... NoOp
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MUST NOT key; MAY value, extras ([0..3] flags)
+	// Responses carry no key, they're matched to requests by opaque.
+	ms := make([]*msg, len(keys))
+	for i, key := range keys {
+		var flags uint32
+		ms[i] = &msg{
+			header: header{
+				Op: opGetQ,
+			},
+			oextras: []interface{}{&flags},
+			key:     key,
+		}
+	}
+
+	err = c.performMulti(ms)
+
+	items = make([]Item, len(keys))
+	found = make([]bool, len(keys))
+	for i, m := range ms {
+		var ierr error
+		items[i], found[i], ierr = c.item(m)
+		if ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	return items, found, err
+}
+
+// item decodes the response to a get request of a batch. Quiet misses and
+// requests that never got a response aren't found.
+func (c *Client) item(m *msg) (item Item, found bool, err error) {
+	if m.Magic != magicRecv {
+		return item, false, nil
+	}
+	if m.ResvOrStatus != StatusOK {
+		return item, false, newError(m.ResvOrStatus)
+	}
+	val, flags, err := c.decompress(m.val, *m.oextras[0].(*uint32))
+	if err != nil {
+		return item, false, err
+	}
+	return Item{val, flags, m.CAS}, true, nil
+}
+
+// performMulti groups requests by the server responsible for their key and
+// pipelines each group, split evenly across the connections to that server.
+// All servers and connections are used in parallel. If some fail, the first
+// error is returned, the requests that got a response are still complete.
+func (c *Client) performMulti(ms []*msg) (err error) {
+	if observe := c.config.Observer; observe != nil && len(ms) > 0 {
+		start := time.Now()
+		defer func() { observe(uint8(ms[0].Op), time.Since(start), err) }()
+	}
+
+	batches := make(map[*server][]*msg)
+	for _, m := range ms {
+		m.key = c.prefix + m.key
+		if err := c.check(m); err != nil {
+			return err
+		}
+		s, err := c.getServer(m.key)
+		if err != nil {
+			return err
+		}
+		batches[s] = append(batches[s], m)
+	}
+
+	// split each server's batch across its pool and run them all in parallel
+	var wg sync.WaitGroup
+	errs := make(chan error, len(batches)*c.config.PoolSize)
+	for s, batch := range batches {
+		size := (len(batch) + c.config.PoolSize - 1) / c.config.PoolSize
+		for len(batch) > 0 {
+			if size > len(batch) {
+				size = len(batch)
+			}
+			wg.Add(1)
+			go func(s *server, chunk []*msg) {
+				defer wg.Done()
+				if err := s.performMulti(chunk); err != nil {
+					errs <- err
+				}
+			}(s, batch[:size])
+			batch = batch[size:]
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	// first error, if any
+	return <-errs
+}
+
+// multiError returns the error for the first request of a batch that received
+// a response with an error status.
+func multiError(ms []*msg) error {
+	for _, m := range ms {
+		if m.Magic == magicRecv && m.ResvOrStatus != StatusOK {
+			return newError(m.ResvOrStatus)
+		}
+	}
+	return nil
 }
 
 // GAT (get and touch) retrieves the value associated with the key and updates
@@ -176,7 +626,11 @@ func (c *Client) GAT(key string, exp uint32) (val string, flags uint32, cas uint
 	}
 
 	err = c.perform(m)
-	return m.val, flags, m.CAS, err
+	if err != nil {
+		return m.val, flags, m.CAS, err
+	}
+	val, flags, err = c.decompress(m.val, flags)
+	return val, flags, m.CAS, err
 }
 
 // Touch updates the expiration time on a key/value pair in the cache.
@@ -196,32 +650,263 @@ func (c *Client) Touch(key string, exp uint32) (cas uint64, err error) {
 	return m.CAS, err
 }
 
-// Set sets a key/value pair in the cache.
+// Set sets a key/value pair in the cache. exp is in seconds if up to 30 days,
+// a UNIX timestamp otherwise (see Expiration above), 0 means no expiration.
 func (c *Client) Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
 	// Variants: [R] Set [Q]
-	return c.setGeneric(opSet, key, val, ocas, flags, exp)
+	return c.setGeneric(context.Background(), opSet, key, val, ocas, flags, exp)
+}
+
+// SetContext sets a key/value pair in the cache. The request is aborted when
+// ctx is done, in which case the returned error has StatusContextError.
+func (c *Client) SetContext(ctx context.Context, key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	return c.setGeneric(ctx, opSet, key, val, ocas, flags, exp)
+}
+
+// SetWithJitter is Set with a random 0 to jitter seconds added to exp, so keys
+// set together don't all expire at once and hit the backend in a stampede. A
+// value that doesn't expire (exp 0) stays that way.
+func (c *Client) SetWithJitter(key, val string, flags, exp, jitter uint32, ocas uint64) (cas uint64, err error) {
+	exp = jitterExp(exp, uint32(rand.Int63n(int64(jitter)+1)), time.Now())
+	return c.setGeneric(context.Background(), opSet, key, val, ocas, flags, exp)
+}
+
+// maxRelativeExp is the largest expiration taken as seconds rather than as a
+// UNIX timestamp.
+const maxRelativeExp = 60 * 60 * 24 * 30
+
+// jitterExp adds j seconds to exp. A relative exp pushed over 30 days would be
+// read as a timestamp in 1970, so it is turned into an absolute one.
+func jitterExp(exp, j uint32, now time.Time) uint32 {
+	switch {
+	case exp == 0:
+		return 0
+	case exp <= maxRelativeExp && exp+j > maxRelativeExp:
+		return uint32(now.Unix()) + exp + j
+	}
+	return exp + j
+}
+
+// SetBytes sets a key/value pair in the cache where the value is a byte slice.
+func (c *Client) SetBytes(key string, val []byte, flags, exp uint32, ocas uint64) (cas uint64, err error) {
+	return c.setGeneric(context.Background(), opSet, key, string(val), ocas, flags, exp)
+}
+
+// SetStream sets a key/value pair in the cache with the value written to the
+// returned writer, straight to the connection, instead of passed in. This
+// avoids holding large values in memory. The size of the value has to be
+// known up front, as it is sent before the value. Closing the writer receives
+// the response and returns the error of the set. Writing more than size bytes
+// fails with ErrInvalidArgs, as does closing the writer early. The request
+// holds one of the server's connections until the writer is closed, so it
+// must always be closed. Streamed values aren't compressed or retried.
+func (c *Client) SetStream(key string, size int, flags, exp uint32) (w io.WriteCloser, err error) {
+	// Variants: [R] Set [Q]
+	// Request : MUST key, value, extras ([0..3] flags, [4..7] expiration)
+	// Response: MUST NOT key, value, extras
+	m := &msg{
+		header: header{
+			Op: opSet,
+		},
+		iextras: []interface{}{flags, exp},
+		key:     c.prefix + key,
+	}
+	if err := c.check(m); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, ErrInvalidArgs
+	}
+	if c.config.MaxValueSize > 0 && size > c.config.MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+
+	s, err := c.getServer(m.key)
+	if err != nil {
+		return nil, err
+	}
+	return s.setStream(m, size)
+}
+
+// SetWithDataType sets a key/value pair in the cache, marking the value with
+// dataType (e.g. DataTypeJSON). This is only accepted by servers that support
+// data types, memcached rejects anything but DataTypeRaw.
+func (c *Client) SetWithDataType(key, val string, flags, exp uint32, ocas uint64, dataType uint8) (cas uint64, err error) {
+	val, flags = c.compress(val, flags)
+	m := &msg{
+		header: header{
+			Op:       opSet,
+			DataType: dataType,
+			CAS:      ocas,
+		},
+		iextras: []interface{}{flags, exp},
+		key:     key,
+		val:     val,
+	}
+
+	err = c.perform(m)
+	return m.CAS, err
+}
+
+// CompareAndSwap sets a key/value pair in the cache but only if the key hasn't
+// been modified since cas was retrieved (e.g., by Get). It returns
+// ErrCASConflict if the key has been modified since and ErrNotFound if it no
+// longer exists.
+func (c *Client) CompareAndSwap(key, val string, flags, exp uint32, cas uint64) (ncas uint64, err error) {
+	if cas == 0 {
+		// a zero CAS would make the set unconditional
+		return 0, ErrInvalidArgs
+	}
+	ncas, err = c.setGeneric(context.Background(), opSet, key, val, cas, flags, exp)
+	if err == ErrKeyExists {
+		return ncas, ErrCASConflict
+	}
+	return ncas, err
+}
+
+// SetFlags changes the flags of the value for key, e.g. to mark it stale,
+// without the caller having to resend it. There is no server op for this, so
+// the value is read and written back with its CAS, retrying if it changed in
+// between. That isn't atomic on the server but never overwrites a concurrent
+// write. The remaining expiration time can't be read, so it is reset to exp.
+// It fails with ErrNotFound if the key doesn't exist and with ErrCASConflict
+// if the value kept changing.
+func (c *Client) SetFlags(key string, flags, exp uint32) (cas uint64, err error) {
+	for i := 0; i < maxCASAttempts; i++ {
+		val, _, ocas, err := c.Get(key)
+		if err != nil {
+			return 0, err
+		}
+
+		cas, err = c.CompareAndSwap(key, val, flags, exp, ocas)
+		if err == ErrCASConflict {
+			// changed since we read it
+			continue
+		}
+		return cas, err
+	}
+	return 0, ErrCASConflict
 }
 
-// Replace replaces an existing key/value in the cache. Fails if key doesn't
-// already exist in cache.
+// SetMulti sets several key/value pairs in the cache, all with the same flags
+// and expiration. The requests for each server are pipelined using the quiet
+// variant of set, so the server only responds to the ones that fail. All
+// requests are sent, the error of the first one that failed is returned.
+func (c *Client) SetMulti(items map[string]string, flags, exp uint32) (err error) {
+	// Variants: SetQ ... NoOp
+	// Request : MUST key, value, extras ([0..3] flags, [4..7] expiration)
+	// Response: only on failure, MUST NOT key, value, extras
+	ms := make([]*msg, 0, len(items))
+	for key, val := range items {
+		val, vflags := c.compress(val, flags)
+		ms = append(ms, &msg{
+			header: header{
+				Op: opSetQ,
+			},
+			iextras: []interface{}{vflags, exp},
+			key:     key,
+			val:     val,
+		})
+	}
+
+	err = c.performMulti(ms)
+	if err != nil {
+		return err
+	}
+	return multiError(ms)
+}
+
+// BulkSet sets many key/value pairs as fast as possible, e.g. to warm a cache.
+// Like SetMulti it pipelines quiet sets, but each item has its own flags and
+// CAS, and items the servers reject, e.g. on a CAS mismatch, are only counted
+// in errored. err is only set if a server or connection failed, in which case
+// the items sent to it may or may not have been stored.
+func (c *Client) BulkSet(items map[string]Item, exp uint32) (errored int, err error) {
+	// Variants: SetQ ... NoOp
+	// Request : MUST key, value, extras ([0..3] flags, [4..7] expiration)
+	// Response: only on failure, MUST NOT key, value, extras
+	ms := make([]*msg, 0, len(items))
+	for key, item := range items {
+		val, flags := c.compress(item.Value, item.Flags)
+		ms = append(ms, &msg{
+			header: header{
+				Op:  opSetQ,
+				CAS: item.CAS,
+			},
+			iextras: []interface{}{flags, exp},
+			key:     key,
+			val:     val,
+		})
+	}
+
+	err = c.performMulti(ms)
+	for _, m := range ms {
+		if m.Magic == magicRecv && m.ResvOrStatus != StatusOK {
+			errored++
+		}
+	}
+	return errored, err
+}
+
+// Replace replaces an existing key/value in the cache. Fails with ErrNotFound
+// if key doesn't already exist in cache.
 func (c *Client) Replace(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
 	// Variants: Replace [Q]
-	return c.setGeneric(opReplace, key, val, ocas, flags, exp)
+	return c.setGeneric(context.Background(), opReplace, key, val, ocas, flags, exp)
 }
 
-// Add adds a new key/value to the cache. Fails if the key already exists in the
-// cache.
+// Add adds a new key/value to the cache. Fails with ErrKeyExists if the key
+// already exists in the cache.
 func (c *Client) Add(key, val string, flags, exp uint32) (cas uint64, err error) {
 	// Variants: Add [Q]
-	return c.setGeneric(opAdd, key, val, 0, flags, exp)
+	return c.setGeneric(context.Background(), opAdd, key, val, 0, flags, exp)
+}
+
+// SetNX is Add reporting whether the value was stored, set is false without an
+// error if the key already exists. Of concurrent callers for a missing key
+// only one gets set, which makes it the building block for locks.
+func (c *Client) SetNX(key, val string, flags, exp uint32) (set bool, err error) {
+	_, err = c.Add(key, val, flags, exp)
+	if err == ErrKeyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetOrRefresh returns the value of key, computing it with fn on a miss and
+// storing it with expiration exp. The value is stored with Add, so of
+// concurrent callers computing a missing key the first one to store its value
+// wins and the others return that value instead of their own. fn may still
+// run in several callers at once. Errors from fn are returned, while failing
+// to store the computed value isn't an error, the value is returned anyway.
+func (c *Client) GetOrRefresh(key string, exp uint32, fn func() (string, error)) (string, error) {
+	val, _, _, err := c.Get(key)
+	if err != ErrNotFound {
+		return val, err
+	}
+
+	val, err = fn()
+	if err != nil {
+		return "", err
+	}
+	_, err = c.Add(key, val, 0, exp)
+	if err == ErrKeyExists {
+		// another caller won, use its value unless it is already gone again
+		won, _, _, err := c.Get(key)
+		if err == nil {
+			return won, nil
+		}
+	}
+	return val, nil
 }
 
 // Set/Add/Replace a key/value pair in the cache.
-func (c *Client) setGeneric(op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
+func (c *Client) setGeneric(ctx context.Context, op opCode, key, val string, ocas uint64, flags, exp uint32) (cas uint64, err error) {
 	// Request : MUST key, value, extras ([0..3] flags, [4..7] expiration)
 	// Response: MUST NOT key, value, extras
 	// CAS: If a CAS is specified (non-zero), all sets only succeed if the key
 	//      exists and has the CAS specified. Otherwise, an error is returned.
+	val, flags = c.compress(val, flags)
 	m := &msg{
 		header: header{
 			Op:  op,
@@ -230,6 +915,7 @@ func (c *Client) setGeneric(op opCode, key, val string, ocas uint64, flags, exp
 		iextras: []interface{}{flags, exp},
 		key:     key,
 		val:     val,
+		ctx:     ctx,
 	}
 
 	err = c.perform(m)
@@ -249,6 +935,22 @@ func (c *Client) Decr(key string, delta, init uint64, exp uint32, ocas uint64) (
 	return c.incrdecr(opDecrement, key, delta, init, exp, ocas)
 }
 
+// expNoCreate as the expiration of an incr/decr makes it fail with
+// ErrNotFound rather than create a missing key.
+const expNoCreate = uint32(0xffffffff)
+
+// IncrExisting increments a value in the cache like Incr, but fails with
+// ErrNotFound instead of creating the key if it doesn't exist.
+func (c *Client) IncrExisting(key string, delta uint64, ocas uint64) (n, cas uint64, err error) {
+	return c.incrdecr(opIncrement, key, delta, 0, expNoCreate, ocas)
+}
+
+// DecrExisting decrements a value in the cache like Decr, but fails with
+// ErrNotFound instead of creating the key if it doesn't exist.
+func (c *Client) DecrExisting(key string, delta uint64, ocas uint64) (n, cas uint64, err error) {
+	return c.incrdecr(opDecrement, key, delta, 0, expNoCreate, ocas)
+}
+
 // Incr/Decr a key/value pair in the cache.
 func (c *Client) incrdecr(op opCode, key string, delta, init uint64, exp uint32, ocas uint64) (n, cas uint64, err error) {
 	// Variants: [R] Incr [Q], [R] Decr [Q]
@@ -275,18 +977,19 @@ func (c *Client) incrdecr(op opCode, key string, delta, init uint64, exp uint32,
 		return
 	}
 	// value is returned as an unsigned 64bit integer (i.e., not as a string)
-	return readInt(m.val), m.CAS, nil
+	n, err = readInt(m.val)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, m.CAS, nil
 }
 
 // Convert string stored to an uint64 (where no actual byte changes are needed).
-func readInt(b string) uint64 {
-	switch len(b) {
-	case 8: // 64 bit
-		return uint64(uint64(b[7]) | uint64(b[6])<<8 | uint64(b[5])<<16 | uint64(b[4])<<24 |
-			uint64(b[3])<<32 | uint64(b[2])<<40 | uint64(b[1])<<48 | uint64(b[0])<<56)
+func readInt(b string) (uint64, error) {
+	if len(b) != 8 {
+		return 0, ErrMalformedResponse
 	}
-
-	panic(fmt.Sprintf("mc: don't know how to parse string with %d bytes", len(b)))
+	return binary.BigEndian.Uint64([]byte(b)), nil
 }
 
 // Append appends the value to the existing value for the key specified. An
@@ -308,10 +1011,44 @@ func (c *Client) Append(key, val string, ocas uint64) (cas uint64, err error) {
 	return m.CAS, err
 }
 
+// maxCASAttempts bounds how often helpers built on CAS retry under contention.
+const maxCASAttempts = 10
+
+// AppendGet appends val to the value for key and returns the full value right
+// after the append. It reads the value and appends with its CAS, retrying if
+// the value changed in between, so the result can't include later writes. It
+// fails with ErrValueNotStored if the key doesn't exist, like Append, and with
+// ErrCASConflict if the value kept changing.
+func (c *Client) AppendGet(key, val string) (full string, err error) {
+	for i := 0; i < maxCASAttempts; i++ {
+		cur, _, cas, err := c.Get(key)
+		if err == ErrNotFound {
+			return "", ErrValueNotStored
+		}
+		if err != nil {
+			return "", err
+		}
+
+		_, err = c.Append(key, val, cas)
+		switch err {
+		case nil:
+			return cur + val, nil
+		case ErrKeyExists:
+			// changed since we read it
+			continue
+		case ErrNotFound:
+			return "", ErrValueNotStored
+		default:
+			return "", err
+		}
+	}
+	return "", ErrCASConflict
+}
+
 // Prepend prepends the value to the existing value for the key specified. An
 // error is thrown if the key doesn't exist.
 func (c *Client) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
-	// Variants: [R] Append [Q]
+	// Variants: [R] Prepend [Q]
 	// Request : MUST key, value; MUST NOT extras
 	// Response: MUST NOT key, value, extras
 	m := &msg{
@@ -329,12 +1066,27 @@ func (c *Client) Prepend(key, val string, ocas uint64) (cas uint64, err error) {
 
 // Del deletes a key/value from the cache.
 func (c *Client) Del(key string) (err error) {
-	return c.DelCAS(key, 0)
+	return c.delCAS(context.Background(), key, 0)
+}
+
+// DelContext deletes a key/value from the cache. The request is aborted when
+// ctx is done, in which case the returned error has StatusContextError.
+func (c *Client) DelContext(ctx context.Context, key string) (err error) {
+	return c.delCAS(ctx, key, 0)
 }
 
 // DelCAS deletes a key/value from the cache but only if the CAS specified
-// matches the CAS in the cache.
+// matches the CAS in the cache. It returns ErrCASConflict if the key has
+// changed since. A zero CAS deletes unconditionally.
 func (c *Client) DelCAS(key string, cas uint64) (err error) {
+	err = c.delCAS(context.Background(), key, cas)
+	if err == ErrKeyExists {
+		return ErrCASConflict
+	}
+	return err
+}
+
+func (c *Client) delCAS(ctx context.Context, key string, cas uint64) (err error) {
 	// Variants: [R] Del [Q]
 	// Request : MUST key; MUST NOT value, extras
 	// Response: MUST NOT key, value, extras
@@ -344,15 +1096,102 @@ func (c *Client) DelCAS(key string, cas uint64) (err error) {
 			CAS: cas,
 		},
 		key: key,
+		ctx: ctx,
 	}
 
 	return c.perform(m)
 }
 
+// GetAndDelete retrieves a value and deletes it from the cache, unless it was
+// changed in between, in which case ErrCASConflict is returned and the value
+// is left in place. This allows claiming an item exactly once.
+func (c *Client) GetAndDelete(key string) (val string, err error) {
+	val, _, cas, err := c.Get(key)
+	if err != nil {
+		return "", err
+	}
+	err = c.DelCAS(key, cas)
+	if err == ErrNotFound {
+		// someone else claimed it first
+		return "", ErrCASConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// DeleteMulti deletes several keys from the cache. The requests for each
+// server are pipelined. The result for each key is returned in errs, nil if it
+// was deleted or e.g. ErrNotFound if it wasn't there. err is only set if some
+// requests got no response at all, those keys are left out of errs.
+func (c *Client) DeleteMulti(keys []string) (errs map[string]error, err error) {
+	// Variants: Del ... NoOp
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MUST NOT key, value, extras
+	ms := make([]*msg, len(keys))
+	for i, key := range keys {
+		ms[i] = &msg{
+			header: header{
+				Op: opDelete,
+			},
+			key: key,
+		}
+	}
+
+	err = c.performMulti(ms)
+
+	errs = make(map[string]error, len(keys))
+	for i, m := range ms {
+		if m.Magic == magicRecv {
+			errs[keys[i]] = newError(m.ResvOrStatus)
+		}
+	}
+	return errs, err
+}
+
+// Do sends a request with an arbitrary opcode for key and returns the raw
+// response, e.g. for commands the client doesn't wrap. extras must be uint8,
+// uint16, uint32 or uint64 values, they are sent in order ahead of the key,
+// other types fail with ErrInvalidArgs. The status of the response is returned
+// as is, err is only set if there was no response, e.g. on a network error.
+// Retries and failover apply as for any request. key may be empty for opcodes
+// that don't take one, such as NOOP or VERSION. Such a request is sent without
+// the client's prefix, and goes to the server the empty key hashes to.
+func (c *Client) Do(op uint8, key, val string, extras []interface{}, cas uint64) (rkey, rval string, rextras []byte, rcas uint64, status uint16, err error) {
+	for _, e := range extras {
+		switch e.(type) {
+		case uint8, uint16, uint32, uint64:
+		default:
+			return "", "", nil, 0, 0, ErrInvalidArgs
+		}
+	}
+
+	m := &msg{
+		header: header{
+			Op:  opCode(op),
+			CAS: cas,
+		},
+		iextras: extras,
+		rextras: []byte{},
+		keyless: true,
+		key:     key,
+		val:     val,
+	}
+
+	err = c.perform(m)
+	if err != nil && (m.Magic != magicRecv || err.(*Error).Status != m.ResvOrStatus) {
+		return "", "", nil, 0, 0, err
+	}
+	rkey = strings.TrimPrefix(m.key, c.prefix)
+	return rkey, m.val, m.rextras, m.CAS, m.ResvOrStatus, nil
+}
+
 // Flush flushes the cache, that is, invalidate all keys. Note, this doesn't
 // typically free memory on a memcache server (doing so compromises the O(1)
 // nature of memcache). Instead nearly all servers do lazy expiration, where
 // they don't free memory but won't return any keys to you that have expired.
+// All servers that are up are flushed, the first error is returned.
 func (c *Client) Flush(when uint32) (err error) {
 	// Variants: Flush [Q]
 	// Request : MUST NOT key, value; MAY extras ([0..3] expiration)
@@ -360,24 +1199,30 @@ func (c *Client) Flush(when uint32) (err error) {
 
 	// optional expiration means that the flush won't become active until that
 	// point in time, hence why the argument is called 'when' as that is more
-	// descriptive of its function.
+	// descriptive of its function. An immediate flush is sent without extras
+	// as some servers reject a zero expiration extra.
 	m := &msg{
 		header: header{
 			Op: opFlush,
 		},
-		iextras: []interface{}{when},
+	}
+	if when != 0 {
+		m.iextras = []interface{}{when}
 	}
 
 	for _, s := range c.servers {
-		if s.isAlive {
-			err = s.perform(m)
+		if !s.down() {
+			if serr := s.perform(m); serr != nil && err == nil {
+				err = serr
+			}
 		}
 	}
-	return err // retrns err from last perform but maybe should handle differently
+	return err
 }
 
-// NoOp sends a No-Op message to the memcache server. This can be used as a
-// heartbeat for the server to check it's functioning fine still.
+// NoOp sends a No-Op message to all memcache servers that are up. This can be
+// used as a heartbeat to check they are functioning fine still. The first
+// error is returned.
 func (c *Client) NoOp() (err error) {
 	// Variants: NoOp
 	// Request : MUST NOT key, value, extras
@@ -389,11 +1234,13 @@ func (c *Client) NoOp() (err error) {
 	}
 
 	for _, s := range c.servers {
-		if s.isAlive {
-			err = s.perform(m)
+		if !s.down() {
+			if serr := s.perform(m); serr != nil && err == nil {
+				err = serr
+			}
 		}
 	}
-	return err // retrns err from last perform but maybe should handle differently
+	return err
 }
 
 // Version gets the version of the memcached server connected to.
@@ -411,7 +1258,7 @@ func (c *Client) Version() (vers map[string]string, err error) {
 
 	vers = make(map[string]string)
 	for _, s := range c.servers {
-		if s.isAlive {
+		if !s.down() {
 			err = s.perform(m)
 			if err == nil {
 				vers[s.address] = m.val
@@ -422,6 +1269,71 @@ func (c *Client) Version() (vers map[string]string, err error) {
 	return
 }
 
+// AuthMechanisms returns the SASL mechanisms supported by each server, keyed
+// by server address.
+func (c *Client) AuthMechanisms() (mechs map[string][]string, err error) {
+	// Variants: SASL List Mechs
+	// Request : MUST NOT key, value, extras
+	// Response: MUST NOT key, extras; MUST value (space separated mechanisms)
+	m := &msg{
+		header: header{
+			Op: opAuthList,
+		},
+	}
+
+	mechs = make(map[string][]string)
+	for _, s := range c.servers {
+		if !s.down() {
+			err = s.perform(m)
+			if err != nil {
+				return nil, err
+			}
+			mechs[s.address] = strings.Fields(m.val)
+		}
+	}
+	return mechs, nil
+}
+
+// Connect opens and authenticates all connections to all servers up front,
+// rather than on first use, so that the first requests don't pay for it and
+// bad credentials show up straight away. It returns the first error.
+func (c *Client) Connect() error {
+	for _, s := range c.servers {
+		err := s.connect(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectAtLeast is Connect for clusters where a flaky server shouldn't stop
+// the client from starting. It tries all servers and only fails if fewer than
+// n could be connected to, returning the first error. With Failover, the
+// servers that couldn't be connected to are marked down, as if a request to
+// them had failed.
+func (c *Client) ConnectAtLeast(n int) error {
+	var firstErr error
+	connected := 0
+	for _, s := range c.servers {
+		err := s.connect(context.Background())
+		if err == nil {
+			connected++
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if c.config.Failover && s.changeAlive(false) {
+			go c.wakeUp(s)
+		}
+	}
+	if connected < n {
+		return firstErr
+	}
+	return nil
+}
+
 // Quit closes the connection with memcached server (nicely).
 func (c *Client) Quit() {
 	// Variants: Quit [Q]
@@ -438,6 +1350,19 @@ func (c *Client) Quit() {
 	}
 }
 
+// Traffic returns the number of bytes sent to and received from all servers
+// since the client was created, e.g. for capacity planning.
+func (c *Client) Traffic() (sent, recvd uint64) {
+	for _, s := range c.servers {
+		for _, sc := range s.conns {
+			ssent, srecvd := sc.traffic()
+			sent += ssent
+			recvd += srecvd
+		}
+	}
+	return
+}
+
 // StatsWithKey returns some statistics about the memcached server. It supports
 // sending across a key to the server to select which statistics should be
 // returned.
@@ -455,7 +1380,7 @@ func (c *Client) StatsWithKey(key string) (map[string]McStats, error) {
 
 	allStats := make(map[string]McStats)
 	for _, s := range c.servers {
-		if s.isAlive {
+		if !s.down() {
 			stats, err := s.performStats(m)
 			if err != nil {
 				return nil, err
@@ -1,10 +1,16 @@
 package mc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -72,24 +78,24 @@ func TestGet(t *testing.T) {
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 
 	// retrieve value with 0 CAS...
-	v1, _, cas1, err := c.getCAS(Key1, 0)
+	v1, _, cas1, err := c.getCAS(context.Background(), Key1, 0)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, Val1, v1, "wrong value: %s", v1)
 
 	// retrieve value with good CAS...
-	v2, _, cas2, err := c.getCAS(Key1, cas1)
+	v2, _, cas2, err := c.getCAS(context.Background(), Key1, cas1)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, v1, v2, "value changed when it shouldn't: %s, %s", v1, v2)
 	assertEqualf(t, cas1, cas2, "CAS changed when it shouldn't: %d, %d", cas1, cas2)
 
 	// retrieve value with bad CAS...
-	v3, _, cas1, err := c.getCAS(Key1, cas1+1)
+	v3, _, cas1, err := c.getCAS(context.Background(), Key1, cas1+1)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, v3, v2, "value changed when it shouldn't: %s, %s", v3, v2)
 	assertEqualf(t, cas1, cas2, "CAS changed when it shouldn't: %d, %d", cas1, cas2)
 
 	// really make sure CAS is bad (above could be an off by one bug...)
-	v4, _, cas1, err := c.getCAS(Key1, cas1+992313128)
+	v4, _, cas1, err := c.getCAS(context.Background(), Key1, cas1+992313128)
 	assertEqualf(t, mcNil, err, "shouldn't be an error: %v", err)
 	assertEqualf(t, v4, v2, "value changed when it shouldn't: %s, %s", v4, v2)
 	assertEqualf(t, cas1, cas2, "CAS changed when it shouldn't: %d, %d", cas1, cas2)
@@ -321,7 +327,7 @@ func TestDelete(t *testing.T) {
 	cas1, err := c.Set(Key1, Val1, 0, 0, 0)
 	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
 	err = c.DelCAS(Key1, cas1+1)
-	assertEqualf(t, ErrKeyExists, err,
+	assertEqualf(t, ErrCASConflict, err,
 		"expected an error for deleting key with wrong CAS: %v", err)
 
 	// confirm it isn't gone...
@@ -1606,3 +1612,1122 @@ func TestStatsReset(t *testing.T) {
 		break // in case there are multiple servers
 	}
 }
+
+// Test GetMulti works...
+func TestGetMulti(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "goo"
+		Key3 = "hoo"
+		Key4 = "missing"
+		Val1 = "moo"
+		Val2 = "bar"
+		Val3 = "zar"
+	)
+
+	vals, err := c.GetMulti(nil)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 0, len(vals), "expected no values: %v", vals)
+
+	_, err = c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set(Key2, Val2, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set(Key3, Val3, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	vals, err = c.GetMulti([]string{Key1, Key2, Key4, Key3})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]string{Key1: Val1, Key2: Val2, Key3: Val3}, vals,
+		"wrong values: %v", vals)
+
+	// all misses...
+	vals, err = c.GetMulti([]string{Key4, Key4 + "2"})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 0, len(vals), "expected no values: %v", vals)
+
+	// make sure the connection is still in a sane state...
+	v, _, _, err := c.Get(Key2)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "wrong value: %s", v)
+	_, _, _, err = c.Get(Key4)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+}
+
+// Test GetBytes/SetBytes work with binary values...
+func TestBytes(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1         = "foo"
+		FLAGS uint32 = 42
+	)
+	Val1 := []byte{0x00, 0xff, 0x10, 0x00, 0x80}
+
+	cas, err := c.SetBytes(Key1, Val1, FLAGS, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, f, cas2, err := c.GetBytes(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "wrong value: %v", v)
+	assertEqualf(t, FLAGS, f, "wrong flags: %v", f)
+	assertEqualf(t, cas, cas2, "CAS shouldn't have changed: %d, %d", cas, cas2)
+
+	c.Del(Key1)
+	v, _, _, err = c.GetBytes(Key1)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+	assertEqualf(t, []byte(nil), v, "expected no value: %v", v)
+}
+
+// Test the context variants...
+func TestContext(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+	)
+
+	ctx := context.Background()
+	_, err := c.SetContext(ctx, Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err := c.GetContext(ctx, Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "wrong value: %s", v)
+
+	// done contexts shouldn't even send the request...
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, _, err = c.GetContext(done, Key1)
+	assertNotEqualf(t, mcNil, err, "expected an error for a canceled context")
+	assertEqualf(t, StatusContextError, err.(*Error).Status, "wrong error: %v", err)
+	err = c.DelContext(done, Key1)
+	assertEqualf(t, StatusContextError, err.(*Error).Status, "wrong error: %v", err)
+
+	// ...and not mark the server as dead
+	err = c.DelContext(ctx, Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.GetContext(ctx, Key1)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+}
+
+// Test SetMulti and DeleteMulti work...
+func TestSetDeleteMulti(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1         = "foo"
+		Key2         = "goo"
+		Key3         = "hoo"
+		Val1         = "moo"
+		Val2         = "bar"
+		Val3         = "zar"
+		FLAGS uint32 = 123
+	)
+
+	items := map[string]string{Key1: Val1, Key2: Val2, Key3: Val3}
+	err := c.SetMulti(items, FLAGS, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	for k, val := range items {
+		v, f, _, err := c.Get(k)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, val, v, "wrong value: %s", v)
+		assertEqualf(t, FLAGS, f, "wrong flags: %d", f)
+	}
+
+	errs, err := c.DeleteMulti([]string{Key1, Key2})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]error{Key1: nil, Key2: nil}, errs, "wrong results: %v", errs)
+	vals, err := c.GetMulti([]string{Key1, Key2, Key3})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]string{Key3: Val3}, vals, "wrong values: %v", vals)
+
+	// deleting missing keys fails but still deletes the others...
+	errs, err = c.DeleteMulti([]string{Key1, Key3})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]error{Key1: ErrNotFound, Key3: nil}, errs,
+		"wrong results: %v", errs)
+	_, _, _, err = c.Get(Key3)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+}
+
+// Test CompareAndSwap, only one of two concurrent swaps should succeed...
+func TestCompareAndSwap(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+		Val1 = "bar"
+	)
+
+	_, err := c.CompareAndSwap(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, ErrInvalidArgs, err, "expected invalid args for 0 CAS: %v", err)
+	_, err = c.CompareAndSwap(Key2, Val1, 0, 0, 1)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+
+	_, err = c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, cas, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	ch := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			_, err := c.CompareAndSwap(Key1, strconv.Itoa(i), 0, 0, cas)
+			ch <- err
+		}(i)
+	}
+	err1, err2 := <-ch, <-ch
+	if err1 == mcNil {
+		assertEqualf(t, ErrCASConflict, err2, "expected CAS conflict: %v", err2)
+	} else {
+		assertEqualf(t, ErrCASConflict, err1, "expected CAS conflict: %v", err1)
+		assertEqualf(t, mcNil, err2, "unexpected error: %v", err2)
+	}
+
+	v, _, cas2, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, v == "0" || v == "1", "wrong value: %s", v)
+	assertNotEqualf(t, cas, cas2, "CAS should have changed")
+}
+
+// Test that empty and oversized keys are rejected without a round trip.
+func TestInvalidKeys(t *testing.T) {
+	c := testInit(t)
+
+	for _, key := range []string{"", strings.Repeat("k", 251)} {
+		_, _, _, err := c.Get(key)
+		assertEqualf(t, ErrInvalidArgs, err, "expected invalid args for get: %v", err)
+		_, err = c.Set(key, "bar", 0, 0, 0)
+		assertEqualf(t, ErrInvalidArgs, err, "expected invalid args for set: %v", err)
+		err = c.Del(key)
+		assertEqualf(t, ErrInvalidArgs, err, "expected invalid args for del: %v", err)
+		_, err = c.GetMulti([]string{"foo", key})
+		assertEqualf(t, ErrInvalidArgs, err, "expected invalid args for get multi: %v", err)
+	}
+
+	key := strings.Repeat("k", 250)
+	_, err := c.Set(key, "bar", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error for longest key: %v", err)
+}
+
+// Test that large values are compressed and transparently decompressed.
+func TestCompression(t *testing.T) {
+	testInit(t)
+
+	const (
+		Key1  = "big"
+		Key2  = "small"
+		Flags = 0x10
+	)
+	Val1 := strings.Repeat("compress me please ", 100)
+	Val2 := "tiny"
+
+	config := DefaultConfig()
+	config.CompressThreshold = 1024
+	c := NewMCwithConfig(mcAddr, user, pass, config)
+	defer c.Quit()
+	raw := NewMC(mcAddr, user, pass)
+	defer raw.Quit()
+
+	_, err := c.Set(Key1, Val1, Flags, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set(Key2, Val2, Flags, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, f, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "wrong value")
+	assertEqualf(t, uint32(Flags), f, "wrong flags")
+	v, f, _, err = raw.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, len(v) < len(Val1), "value wasn't compressed: %d bytes", len(v))
+	assertEqualf(t, Flags|FlagCompressed, f, "compressed flag not set")
+
+	v, f, _, err = raw.Get(Key2)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "small value shouldn't be compressed")
+	assertEqualf(t, uint32(Flags), f, "wrong flags")
+
+	vals, err := c.GetMulti([]string{Key1, Key2})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]string{Key1: Val1, Key2: Val2}, vals, "wrong values")
+}
+
+// Test storing Go values with the gob and JSON codecs.
+func TestCodec(t *testing.T) {
+	c := testInit(t)
+
+	type point struct {
+		X, Y int
+		Name string
+	}
+	const Key1 = "point"
+	p := point{1, 2, "a"}
+
+	for _, cd := range []*Codec{GobCodec, JSONCodec} {
+		_, err := cd.Set(c, Key1, p, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		var got point
+		_, err = cd.Get(c, Key1, &got)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, p, got, "wrong value")
+	}
+
+	// last stored with JSON
+	var got point
+	_, err := GobCodec.Get(c, Key1, &got)
+	assertEqualf(t, ErrCodecMismatch, err, "expected a codec mismatch: %v", err)
+
+	_, err = c.Set(Key1, "plain", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = JSONCodec.Get(c, Key1, &got)
+	assertEqualf(t, ErrCodecMismatch, err, "expected a codec mismatch: %v", err)
+
+	_, err = JSONCodec.Set(c, Key1, make(chan int), 0)
+	assertNotEqualf(t, mcNil, err, "expected a marshal error")
+	assertEqualf(t, StatusInvalidArgs, err.(*Error).Status, "wrong status: %v", err)
+}
+
+// Test that the bytes sent and received are counted.
+func TestTraffic(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+	)
+
+	sent, recvd := c.Traffic()
+	_, err := c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	sent2, recvd2 := c.Traffic()
+
+	// set: header, flags, exp, key, value; get: header, key
+	assertEqualf(t, sent+24+8+3+3+24+3, sent2, "wrong number of bytes sent")
+	// set: header; get: header, flags, value
+	assertEqualf(t, recvd+24+24+4+3, recvd2, "wrong number of bytes received")
+}
+
+// Test that a prefixed client keeps its keys apart.
+func TestWithPrefix(t *testing.T) {
+	c := testInit(t)
+	p := c.WithPrefix("app:")
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+		Val2 = "baz"
+	)
+
+	_, err := c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = p.Set(Key1, Val2, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "unprefixed key overwritten")
+	v, _, _, err = c.Get("app:" + Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "prefixed value not stored under prefixed key")
+	v, _, _, err = p.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val2, v, "wrong value from prefixed client")
+
+	vals, err := p.GetMulti([]string{Key1, "missing"})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]string{Key1: Val2}, vals, "prefix not stripped from keys")
+
+	err = p.Del(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unprefixed key deleted: %v", err)
+
+	_, err = p.Set(strings.Repeat("k", 250), Val1, 0, 0, 0)
+	assertEqualf(t, ErrInvalidArgs, err, "prefix not counted in key length: %v", err)
+}
+
+// Test that GetK returns the key it was asked for.
+func TestGetK(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+		Val1 = "bar"
+	)
+
+	cas, err := c.Set(Key1, Val1, 5, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	k, v, f, cas2, err := c.GetK(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Key1, k, "wrong key")
+	assertEqualf(t, Val1, v, "wrong value")
+	assertEqualf(t, uint32(5), f, "wrong flags")
+	assertEqualf(t, cas, cas2, "wrong CAS")
+
+	k, _, _, _, err = c.WithPrefix("app:").GetK(Key1)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+	_, err = c.Set("app:"+Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	k, _, _, _, err = c.WithPrefix("app:").GetK(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Key1, k, "prefix not stripped from key")
+
+	_, _, _, _, err = c.GetK(Key2)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+}
+
+// Test GetAndDelete, only one of two concurrent claims should succeed.
+func TestGetAndDelete(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "job"
+		Val1 = "work"
+	)
+
+	_, err := c.GetAndDelete(Key1)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+
+	_, err = c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, err := c.GetAndDelete(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "wrong value")
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "key wasn't deleted: %v", err)
+
+	_, err = c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	ch := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.GetAndDelete(Key1)
+			ch <- err
+		}()
+	}
+	err1, err2 := <-ch, <-ch
+	if err1 == mcNil {
+		assertTruef(t, err2 == ErrCASConflict || err2 == ErrNotFound,
+			"expected the second claim to fail: %v", err2)
+	} else {
+		assertTruef(t, err1 == ErrCASConflict || err1 == ErrNotFound,
+			"expected the first claim to fail: %v", err1)
+		assertEqualf(t, mcNil, err2, "unexpected error: %v", err2)
+	}
+}
+
+// Test sending raw requests with Do.
+func TestDo(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+		Val1 = "bar"
+	)
+
+	cas, err := c.Set(Key1, Val1, 0xcafe, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	// get and touch, with the expiration as extras and flags in the response
+	k, v, extras, cas2, status, err := c.Do(uint8(opGATK), Key1, "", []interface{}{uint32(0)}, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, StatusOK, status, "wrong status")
+	assertEqualf(t, Key1, k, "wrong key")
+	assertEqualf(t, Val1, v, "wrong value")
+	assertEqualf(t, []byte{0, 0, 0xca, 0xfe}, extras, "wrong extras")
+	assertEqualf(t, cas, cas2, "wrong CAS")
+
+	// a miss is a status, not an error
+	_, _, extras, _, status, err = c.Do(uint8(opGet), Key2, "", nil, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, StatusNotFound, status, "wrong status")
+	assertEqualf(t, 0, len(extras), "unexpected extras")
+
+	_, _, _, _, _, err = c.Do(uint8(opGet), strings.Repeat("k", maxKeyLen+1), "", nil, 0)
+	assertEqualf(t, ErrInvalidArgs, err, "expected invalid args: %v", err)
+
+	// extras of a type that can't be encoded are refused rather than panic
+	_, _, _, _, _, err = c.Do(uint8(opGATK), Key1, "", []interface{}{1}, 0)
+	assertEqualf(t, ErrInvalidArgs, err, "expected invalid args: %v", err)
+}
+
+// Test Do sends opcodes that don't take a key, also from a prefixed client.
+func TestDoKeyless(t *testing.T) {
+	c := testInit(t)
+
+	for _, c := range []*Client{c, c.WithPrefix("app:")} {
+		_, v, _, _, status, err := c.Do(uint8(opVersion), "", "", nil, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, StatusOK, status, "wrong status")
+		assertNotEqualf(t, "", v, "expected a version")
+
+		_, _, _, _, status, err = c.Do(uint8(opNoop), "", "", nil, 0)
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+		assertEqualf(t, StatusOK, status, "wrong status")
+	}
+}
+
+// Test that IncrExisting and DecrExisting don't create missing keys.
+func TestIncrDecrExisting(t *testing.T) {
+	c := testInit(t)
+
+	const Key1 = "counter"
+
+	_, _, err := c.IncrExisting(Key1, 1, 0)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+	_, _, err = c.DecrExisting(Key1, 1, 0)
+	assertEqualf(t, ErrNotFound, err, "expected missing key: %v", err)
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "key shouldn't have been created: %v", err)
+
+	_, err = c.Set(Key1, "10", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	n, _, err := c.IncrExisting(Key1, 5, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(15), n, "wrong value after incr")
+	n, _, err = c.DecrExisting(Key1, 3, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(12), n, "wrong value after decr")
+}
+
+// Test that GetMultiCAS returns the flags and CAS of each value.
+func TestGetMultiCAS(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "bar"
+		Key3 = "missing"
+	)
+
+	cas1, err := c.Set(Key1, "v1", 1, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	cas2, err := c.Set(Key2, "v2", 2, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	items, err := c.GetMultiCAS([]string{Key1, Key2, Key3})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string]Item{
+		Key1: {"v1", 1, cas1},
+		Key2: {"v2", 2, cas2},
+	}, items, "wrong items")
+
+	// CAS guarded write with the returned CAS
+	_, err = c.Set(Key1, "v3", 0, 0, items[Key1].CAS)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set(Key1, "v4", 0, 0, items[Key1].CAS)
+	assertEqualf(t, ErrKeyExists, err, "expected CAS mismatch: %v", err)
+}
+
+// Test that GetOK tells a miss apart from errors.
+func TestGetOK(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+	)
+
+	_, found, _, _, err := c.GetOK(Key1)
+	assertEqualf(t, mcNil, err, "a miss shouldn't be an error: %v", err)
+	assertEqualf(t, false, found, "missing key found")
+
+	cas, err := c.Set(Key1, Val1, 3, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, found, f, cas2, err := c.GetOK(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, true, found, "key not found")
+	assertEqualf(t, Val1, v, "wrong value")
+	assertEqualf(t, uint32(3), f, "wrong flags")
+	assertEqualf(t, cas, cas2, "wrong CAS")
+
+	_, found, _, _, err = c.GetOK("")
+	assertEqualf(t, ErrInvalidArgs, err, "expected invalid args: %v", err)
+	assertEqualf(t, false, found, "invalid key found")
+}
+
+// Test that AppendGet returns the value right after its append, even with
+// concurrent appends.
+func TestAppendGet(t *testing.T) {
+	c := testInit(t)
+
+	const Key1 = "list"
+
+	_, err := c.AppendGet(Key1, "a")
+	assertEqualf(t, ErrValueNotStored, err, "expected value not stored: %v", err)
+
+	_, err = c.Set(Key1, "", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	type result struct {
+		full string
+		err  error
+	}
+	ch := make(chan result)
+	for _, v := range []string{"a", "b", "c"} {
+		go func(v string) {
+			full, err := c.AppendGet(Key1, v)
+			ch <- result{full, err}
+		}(v)
+	}
+	var fulls []string
+	for i := 0; i < 3; i++ {
+		r := <-ch
+		assertEqualf(t, mcNil, r.err, "unexpected error: %v", r.err)
+		fulls = append(fulls, r.full)
+	}
+
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 3, len(v), "wrong final value: %s", v)
+	lens := make(map[int]bool)
+	for _, full := range fulls {
+		// each result is the value at the time of its append
+		assertTruef(t, strings.HasPrefix(v, full), "%q isn't a prefix of %q", full, v)
+		lens[len(full)] = true
+	}
+	assertEqualf(t, map[int]bool{1: true, 2: true, 3: true}, lens,
+		"results don't match one append each: %v", fulls)
+}
+
+// Test expirations given as UNIX timestamps.
+func TestAbsoluteExpiration(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "future"
+		Key2 = "past"
+		Val1 = "bar"
+	)
+
+	yearFromNow := uint32(time.Now().AddDate(1, 0, 0).Unix())
+	_, err := c.Set(Key1, Val1, 0, yearFromNow, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "value with future timestamp expired: %v", err)
+	assertEqualf(t, Val1, v, "wrong value")
+
+	hourAgo := uint32(time.Now().Add(-time.Hour).Unix())
+	_, err = c.Set(Key2, Val1, 0, hourAgo, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, _, _, err = c.Get(Key2)
+	assertEqualf(t, ErrNotFound, err, "value with past timestamp didn't expire: %v", err)
+}
+
+// Test values over MaxValueSize are refused without reaching the server.
+func TestMaxValueSize(t *testing.T) {
+	testInit(t)
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+	)
+
+	config := DefaultConfig()
+	config.MaxValueSize = 8
+	c := NewMCwithConfig(mcAddr, user, pass, config)
+	defer c.Quit()
+
+	_, err := c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	big := strings.Repeat("x", 9)
+	_, err = c.Set(Key1, big, 0, 0, 0)
+	assertEqualf(t, ErrValueTooLarge, err, "expected too large error: %v", err)
+	_, err = c.Replace(Key1, big, 0, 0, 0)
+	assertEqualf(t, ErrValueTooLarge, err, "expected too large error: %v", err)
+	_, err = c.Append(Key1, big, 0)
+	assertEqualf(t, ErrValueTooLarge, err, "expected too large error: %v", err)
+	_, err = c.Prepend(Key1, big, 0)
+	assertEqualf(t, ErrValueTooLarge, err, "expected too large error: %v", err)
+
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "value changed: %v", v)
+}
+
+// Test GetMultiOrdered returns items in the order of the keys.
+func TestGetMultiOrdered(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "bar"
+		Key3 = "missing"
+	)
+
+	cas1, err := c.Set(Key1, "v1", 1, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	cas2, err := c.Set(Key2, "v2", 2, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	items, found, err := c.GetMultiOrdered([]string{Key2, Key3, Key1, Key2})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, []bool{true, false, true, true}, found, "wrong hits")
+	assertEqualf(t, []Item{
+		{"v2", 2, cas2},
+		{},
+		{"v1", 1, cas1},
+		{"v2", 2, cas2},
+	}, items, "wrong items")
+}
+
+// Test SetFlags keeps the value but changes its flags.
+func TestSetFlags(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+		Val1 = "bar"
+	)
+
+	_, err := c.Set(Key1, Val1, 1, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	cas, err := c.SetFlags(Key1, 2, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	v, f, cas2, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "value changed: %v", v)
+	assertEqualf(t, uint32(2), f, "wrong flags: %v", f)
+	assertEqualf(t, cas, cas2, "wrong cas: %v", cas2)
+
+	_, err = c.SetFlags(Key2, 2, 0)
+	assertEqualf(t, ErrNotFound, err, "expected not found: %v", err)
+}
+
+// Test the observer is told about every request.
+func TestObserver(t *testing.T) {
+	testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+		Val1 = "bar"
+	)
+
+	var ops []opCode
+	var errs []error
+	config := DefaultConfig()
+	config.Observer = func(op uint8, dur time.Duration, err error) {
+		assertTruef(t, dur > 0, "no duration for op %v", op)
+		ops = append(ops, opCode(op))
+		errs = append(errs, err)
+	}
+	c := NewMCwithConfig(mcAddr, user, pass, config)
+	defer c.Quit()
+
+	c.Set(Key1, Val1, 0, 0, 0)
+	c.Get(Key2)
+	c.GetMulti([]string{Key1, Key2})
+	assertEqualf(t, []opCode{opSet, opGet, opGetKQ}, ops, "wrong ops observed")
+	assertEqualf(t, []error{nil, ErrNotFound, nil}, errs, "wrong errors observed")
+}
+
+// Test Exists.
+func TestExists(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+	)
+
+	_, err := c.Set(Key1, strings.Repeat("x", 100*1024), 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	found, err := c.Exists(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, found, "key should exist")
+	found, err = c.Exists(Key2)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, !found, "key shouldn't exist")
+}
+
+// Test only one of many concurrent SetNX calls stores its value.
+func TestSetNX(t *testing.T) {
+	testInit(t)
+
+	const (
+		Key1    = "foo"
+		Callers = 20
+	)
+
+	config := DefaultConfig()
+	config.PoolSize = 4
+	c := NewMCwithConfig(mcAddr, user, pass, config)
+	defer c.Quit()
+
+	var wg sync.WaitGroup
+	sets := make(chan string, Callers)
+	errs := make(chan error, Callers)
+	for i := 0; i < Callers; i++ {
+		wg.Add(1)
+		go func(val string) {
+			defer wg.Done()
+			set, err := c.SetNX(Key1, val, 0, 0)
+			errs <- err
+			if set {
+				sets <- val
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(sets)
+	close(errs)
+
+	for err := range errs {
+		assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	}
+	assertEqualf(t, 1, len(sets), "expected exactly one caller to set the key")
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, <-sets, v, "value isn't the winner's")
+}
+
+// Test locks exclude each other and are only released by their holder.
+func TestLock(t *testing.T) {
+	c := testInit(t)
+
+	const Key1 = "lock"
+
+	lock, acquired, err := c.AcquireLock(Key1, 10)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, acquired, "lock should have been acquired")
+	_, acquired, err = c.AcquireLock(Key1, 10)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertTruef(t, !acquired, "lock is already held")
+
+	err = lock.Release()
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	err = lock.Release()
+	assertEqualf(t, ErrLockLost, err, "expected lock lost: %v", err)
+
+	// as if the lock expired and someone else acquired it
+	lock, _, err = c.AcquireLock(Key1, 10)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.Set(Key1, "someone else", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	err = lock.Release()
+	assertEqualf(t, ErrLockLost, err, "expected lock lost: %v", err)
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "other holder's lock was released: %v", err)
+	assertEqualf(t, "someone else", v, "other holder's lock was changed")
+}
+
+// Test sending mixed requests in one batch.
+func TestBatch(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "bar"
+		Key3 = "counter"
+		Key4 = "missing"
+	)
+
+	cas1, err := c.Set(Key1, "v1", 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	var b Batch
+	b.Set(Key2, "v2", 2, 0, 0)
+	b.Set(Key1, "v3", 0, 0, cas1+1)
+	b.Incr(Key3, 5, 10, 0)
+	b.Incr(Key3, 5, 10, 0)
+	b.Del(Key4)
+	b.Del(Key1)
+	assertEqualf(t, 6, b.Len(), "wrong batch length")
+
+	results, err := c.DoBatch(&b)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 6, len(results), "wrong number of results")
+	assertEqualf(t, mcNil, results[0].Err, "unexpected error for set: %v", results[0].Err)
+	assertTruef(t, results[0].CAS != 0, "no cas for set")
+	assertEqualf(t, ErrKeyExists, results[1].Err, "expected CAS mismatch: %v", results[1].Err)
+	assertEqualf(t, mcNil, results[2].Err, "unexpected error for incr: %v", results[2].Err)
+	assertEqualf(t, uint64(10), results[2].N, "wrong initial counter")
+	assertEqualf(t, uint64(15), results[3].N, "wrong incremented counter")
+	assertEqualf(t, ErrNotFound, results[4].Err, "expected not found: %v", results[4].Err)
+	assertEqualf(t, mcNil, results[5].Err, "unexpected error for del: %v", results[5].Err)
+
+	v, f, _, err := c.Get(Key2)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "v2", v, "wrong value")
+	assertEqualf(t, uint32(2), f, "wrong flags")
+	_, _, _, err = c.Get(Key1)
+	assertEqualf(t, ErrNotFound, err, "expected not found: %v", err)
+}
+
+// Test jittered expirations stay on the right side of the 30 day boundary.
+func TestJitterExp(t *testing.T) {
+	const day = 60 * 60 * 24
+	now := time.Unix(1600000000, 0)
+
+	tests := []struct {
+		exp, j, want uint32
+	}{
+		{0, 10, 0},
+		{60, 10, 70},
+		{30 * day, 0, 30 * day},
+		{30*day - 5, 10, 1600000000 + 30*day + 5},
+		{1600000000, 10, 1600000010},
+	}
+	for _, tt := range tests {
+		got := jitterExp(tt.exp, tt.j, now)
+		assertEqualf(t, tt.want, got, "wrong expiration for %d + %d", tt.exp, tt.j)
+	}
+
+	c := testInit(t)
+	_, err := c.SetWithJitter("foo", "bar", 0, 30*day-1, 10, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, mcNil, err, "value expired straight away: %v", err)
+	assertEqualf(t, "bar", v, "wrong value")
+}
+
+// Test setting a value by streaming it.
+func TestSetStream(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "bar"
+	)
+	chunk := strings.Repeat("0123456789", 1000)
+
+	w, err := c.SetStream(Key1, 3*len(chunk), 5, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	for i := 0; i < 3; i++ {
+		_, err = io.WriteString(w, chunk)
+		assertEqualf(t, nil, err, "unexpected write error: %v", err)
+	}
+	_, err = io.WriteString(w, "x")
+	assertEqualf(t, ErrInvalidArgs, err, "expected writing past the size to fail: %v", err)
+	err = w.Close()
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	v, f, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, strings.Repeat(chunk, 3), v, "wrong value")
+	assertEqualf(t, uint32(5), f, "wrong flags")
+
+	// closing early drops the request, and the connection with it
+	w, err = c.SetStream(Key2, 10, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	io.WriteString(w, "short")
+	err = w.Close()
+	assertEqualf(t, ErrInvalidArgs, err, "expected closing early to fail: %v", err)
+	_, _, _, err = c.Get(Key2)
+	assertEqualf(t, ErrNotFound, err, "expected not found: %v", err)
+}
+
+// Test reading a value as a stream.
+func TestGetStream(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+	)
+	val := strings.Repeat("0123456789", 10000)
+
+	_, err := c.Set(Key1, val, 5, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	r, f, size, err := c.GetStream(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint32(5), f, "wrong flags")
+	assertEqualf(t, len(val), size, "wrong size")
+	b, err := ioutil.ReadAll(r)
+	assertEqualf(t, nil, err, "unexpected read error: %v", err)
+	assertEqualf(t, val, string(b), "wrong value")
+	assertEqualf(t, nil, r.Close(), "unexpected close error")
+
+	// closing early skips the rest, leaving the connection usable
+	r, _, _, err = c.GetStream(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = io.ReadFull(r, make([]byte, 10))
+	assertEqualf(t, nil, err, "unexpected read error: %v", err)
+	assertEqualf(t, nil, r.Close(), "unexpected close error")
+	v, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, v, "wrong value after an early close")
+
+	_, _, _, err = c.GetStream(Key2)
+	assertEqualf(t, ErrNotFound, err, "expected not found: %v", err)
+}
+
+// Test Gets followed by CompareAndSwap.
+func TestGets(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Val1 = "bar"
+	)
+
+	cas, err := c.Set(Key1, Val1, 0, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	v, cas2, err := c.Gets(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, v, "wrong value")
+	assertEqualf(t, cas, cas2, "wrong cas")
+
+	_, err = c.CompareAndSwap(Key1, "baz", 0, 0, cas2)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = c.CompareAndSwap(Key1, "qux", 0, 0, cas2)
+	assertEqualf(t, ErrCASConflict, err, "expected CAS conflict: %v", err)
+}
+
+// Test values of an old schema version are refused rather than unmarshalled.
+func TestCodecVersioned(t *testing.T) {
+	c := testInit(t)
+
+	type pointV1 struct {
+		X, Y int
+	}
+	type pointV2 struct {
+		X, Y string
+	}
+	const Key1 = "point"
+
+	_, err := GobCodec.SetVersioned(c, Key1, pointV1{1, 2}, 1, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	var got1 pointV1
+	_, err = GobCodec.GetVersioned(c, Key1, &got1, 1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, pointV1{1, 2}, got1, "wrong value")
+
+	var got2 pointV2
+	_, err = GobCodec.GetVersioned(c, Key1, &got2, 2)
+	assertEqualf(t, ErrVersionMismatch, err, "expected a version mismatch: %v", err)
+	assertEqualf(t, StatusNotFound, err.(*Error).Status, "mismatch should look like a miss")
+	assertEqualf(t, pointV2{}, got2, "value unmarshalled despite the mismatch")
+}
+
+// Test BulkSet counts rejected items without failing.
+func TestBulkSet(t *testing.T) {
+	c := testInit(t)
+
+	items := make(map[string]Item)
+	for i := 0; i < 100; i++ {
+		items["k"+strconv.Itoa(i)] = Item{Value: "v" + strconv.Itoa(i), Flags: uint32(i)}
+	}
+	// CAS mismatches, as the keys don't exist
+	items["bad1"] = Item{Value: "x", CAS: 1}
+	items["bad2"] = Item{Value: "x", CAS: 1}
+
+	errored, err := c.BulkSet(items, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, 2, errored, "wrong number of rejected items")
+
+	v, f, _, err := c.Get("k42")
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, "v42", v, "wrong value")
+	assertEqualf(t, uint32(42), f, "wrong flags")
+}
+
+// Test GetInto reads into a caller's buffer and reports the size needed.
+func TestGetInto(t *testing.T) {
+	c := testInit(t)
+
+	const (
+		Key1 = "foo"
+		Key2 = "missing"
+		Val1 = "bar"
+	)
+
+	cas, err := c.Set(Key1, Val1, 7, 0, 0)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+
+	dst := make([]byte, 8)
+	n, flags, rcas, err := c.GetInto(Key1, dst)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, Val1, string(dst[:n]), "wrong value: %q", dst[:n])
+	assertEqualf(t, uint32(7), flags, "wrong flags: %v", flags)
+	assertEqualf(t, cas, rcas, "wrong cas: %v", rcas)
+
+	n, _, _, err = c.GetInto(Key1, make([]byte, 2))
+	assertEqualf(t, ErrValueTooLarge, err, "expected value too large error: %v", err)
+	assertEqualf(t, len(Val1), n, "wrong size: %v", n)
+
+	n, _, _, err = c.GetInto(Key1, nil)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, len(Val1), n, "wrong size: %v", n)
+
+	// the connection stays usable after a too small buffer
+	_, _, _, err = c.GetInto(Key2, dst)
+	assertEqualf(t, ErrNotFound, err, "expected not found error: %v", err)
+}
+
+// Test GetOrRefresh only computes missing values and that concurrent callers
+// agree on the stored one.
+func TestGetOrRefresh(t *testing.T) {
+	testInit(t)
+
+	const (
+		Key1    = "foo"
+		Key2    = "bar"
+		Callers = 20
+	)
+
+	config := DefaultConfig()
+	config.PoolSize = 4
+	c := NewMCwithConfig(mcAddr, user, pass, config)
+	defer c.Quit()
+
+	type result struct {
+		val string
+		err error
+	}
+	var wg sync.WaitGroup
+	results := make(chan result, Callers)
+	for i := 0; i < Callers; i++ {
+		wg.Add(1)
+		go func(val string) {
+			defer wg.Done()
+			v, err := c.GetOrRefresh(Key1, 0, func() (string, error) {
+				return val, nil
+			})
+			results <- result{v, err}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(results)
+
+	stored, _, _, err := c.Get(Key1)
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	for r := range results {
+		assertEqualf(t, mcNil, r.err, "unexpected error: %v", r.err)
+		assertEqualf(t, stored, r.val, "caller got a value that wasn't stored")
+	}
+
+	// a hit doesn't compute the value
+	v, err := c.GetOrRefresh(Key1, 0, func() (string, error) {
+		t.Errorf("value computed for a cached key")
+		return "", nil
+	})
+	assertEqualf(t, mcNil, err, "unexpected error: %v", err)
+	assertEqualf(t, stored, v, "wrong value: %v", v)
+
+	// errors computing the value are returned and nothing is stored
+	fnErr := errors.New("test failure")
+	_, err = c.GetOrRefresh(Key2, 0, func() (string, error) {
+		return "", fnErr
+	})
+	assertEqualf(t, fnErr, err, "expected the computing error: %v", err)
+	_, _, _, err = c.Get(Key2)
+	assertEqualf(t, ErrNotFound, err, "expected not found: %v", err)
+}
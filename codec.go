@@ -0,0 +1,100 @@
+package mc
+
+// Store Go values in the cache by marshalling them.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec stores arbitrary Go values in the cache by marshalling them. Flag is
+// set in the flags of every value it stores, so that Get can tell values that
+// weren't stored with the codec apart.
+type Codec struct {
+	Marshal   func(v interface{}) ([]byte, error)
+	Unmarshal func(data []byte, v interface{}) error
+	Flag      uint32
+}
+
+// Codecs for the gob and JSON encodings.
+var (
+	GobCodec = &Codec{
+		Marshal:   gobMarshal,
+		Unmarshal: gobUnmarshal,
+		Flag:      1 << 30,
+	}
+	JSONCodec = &Codec{
+		Marshal:   json.Marshal,
+		Unmarshal: json.Unmarshal,
+		Flag:      1 << 29,
+	}
+)
+
+func gobMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func gobUnmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Set marshals v and stores it under key.
+func (cd *Codec) Set(c *Client, key string, v interface{}, exp uint32) (cas uint64, err error) {
+	b, err := cd.Marshal(v)
+	if err != nil {
+		return 0, wrapError(StatusInvalidArgs, err)
+	}
+	return c.SetBytes(key, b, cd.Flag, exp, 0)
+}
+
+// Get retrieves the value stored under key and unmarshals it into v. It
+// returns ErrCodecMismatch if the value wasn't stored with this codec.
+func (cd *Codec) Get(c *Client, key string, v interface{}) (cas uint64, err error) {
+	b, flags, cas, err := c.GetBytes(key)
+	if err != nil {
+		return cas, err
+	}
+	if flags&cd.Flag == 0 {
+		return cas, ErrCodecMismatch
+	}
+	err = cd.Unmarshal(b, v)
+	if err != nil {
+		return cas, wrapError(StatusInvalidArgs, err)
+	}
+	return cas, nil
+}
+
+// SetVersioned is Set with the encoded value prefixed by version, the version
+// of the schema of v. Values stored this way must be read with GetVersioned.
+func (cd *Codec) SetVersioned(c *Client, key string, v interface{}, version uint8, exp uint32) (cas uint64, err error) {
+	b, err := cd.Marshal(v)
+	if err != nil {
+		return 0, wrapError(StatusInvalidArgs, err)
+	}
+	return c.SetBytes(key, append([]byte{version}, b...), cd.Flag, exp, 0)
+}
+
+// GetVersioned is Get for values stored with SetVersioned. If the value was
+// stored with another version than version, it isn't unmarshalled, as its
+// layout may not match v, and ErrVersionMismatch is returned. That error has
+// StatusNotFound, so callers can treat it like a miss and refill the value.
+func (cd *Codec) GetVersioned(c *Client, key string, v interface{}, version uint8) (cas uint64, err error) {
+	b, flags, cas, err := c.GetBytes(key)
+	if err != nil {
+		return cas, err
+	}
+	if flags&cd.Flag == 0 {
+		return cas, ErrCodecMismatch
+	}
+	if len(b) == 0 || b[0] != version {
+		return cas, ErrVersionMismatch
+	}
+	err = cd.Unmarshal(b[1:], v)
+	if err != nil {
+		return cas, wrapError(StatusInvalidArgs, err)
+	}
+	return cas, nil
+}
@@ -0,0 +1,45 @@
+package mc
+
+// Transparent compression of large values.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// FlagCompressed is set in the flags of values that were gzip compressed
+// because they were at least Config.CompressThreshold bytes long. It is
+// cleared again from the flags returned by gets.
+const FlagCompressed uint32 = 1 << 31
+
+// compress gzips val if compression is enabled and val is large enough.
+func (c *Client) compress(val string, flags uint32) (string, uint32) {
+	if c.config.CompressThreshold <= 0 || len(val) < c.config.CompressThreshold {
+		return val, flags
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	// writing to a bytes.Buffer can't fail
+	w.Write([]byte(val))
+	w.Close()
+	return buf.String(), flags | FlagCompressed
+}
+
+// decompress reverses compress for a value retrieved from the server.
+func (c *Client) decompress(val string, flags uint32) (string, uint32, error) {
+	if c.config.CompressThreshold <= 0 || flags&FlagCompressed == 0 {
+		return val, flags, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewBufferString(val))
+	if err != nil {
+		return "", flags, wrapError(StatusMalformedResponse, err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", flags, wrapError(StatusMalformedResponse, err)
+	}
+	return string(b), flags &^ FlagCompressed, nil
+}
@@ -3,25 +3,79 @@ package mc
 //
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
 	"time"
 )
 
 // Config holds the Memcache client configuration. Use DefaultConfig to get
 // an initialized version.
 type Config struct {
-	Hasher     hasher
+	Hasher hasher
+	// Retries is the number of attempts made for requests that fail with a
+	// network error or a transient server error (busy, temporary failure, out
+	// of memory). The delay between attempts starts at RetryDelay and doubles
+	// each time, plus up to 50% jitter.
 	Retries    int
 	RetryDelay time.Duration
 	Failover   bool
+	// FailureThreshold is the number of requests to a server that must fail
+	// with a network error in a row for it to be marked down for
+	// DownRetryDelay. While down, its keys go to the next server with
+	// Failover, and fail straight away without, rather than wait for timeouts.
+	// 0 means 1 with Failover and never marking servers down without it.
+	FailureThreshold int
 	// ConnectionTimeout is currently used to timeout getting connections from
 	// pool, as a sending deadline and as a reading deadline. Worst case this
-	// means a request can take 3 times the ConnectionTimeout.
-	ConnectionTimeout  time.Duration
+	// means a request can take 3 times the ConnectionTimeout. Opening a
+	// connection, including TLS and authentication, must also complete within
+	// it.
+	ConnectionTimeout time.Duration
+	// ReadTimeout and WriteTimeout, if non-zero, replace ConnectionTimeout as
+	// the reading and sending deadline respectively. A slow write usually
+	// means an overloaded server, while a slow read may just be a large value.
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
 	DownRetryDelay     time.Duration
 	PoolSize           int
 	TcpKeepAlive       bool
 	TcpKeepAlivePeriod time.Duration
-	TcpNoDelay         bool
+	// TcpNoDelay disables Nagle's algorithm. Requests and responses are mostly
+	// small and every request waits for its response, so letting TCP hold
+	// back small packets to coalesce them only adds latency, up to 40ms with
+	// delayed ACKs.
+	TcpNoDelay bool
+	// DialContext, if set, is used instead of net.Dialer to open connections
+	// to the servers, e.g. to use TLS or an in-memory connection in tests.
+	// The TCP options above only apply if it returns a *net.TCPConn.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// TLSConfig, if set, makes the client talk to the servers over TLS. If it
+	// has no ServerName, the host part of the server address is used.
+	TLSConfig *tls.Config
+	// MaxValueSize is the largest value (after compression) that is sent to
+	// the servers, larger ones fail with ErrValueTooLarge without a round trip.
+	// Raise it for servers started with a larger -I. 0 disables the check.
+	MaxValueSize int
+	// MaxResponseSize is the largest response body accepted from the servers,
+	// so a broken server can't make the client allocate gigabytes. Larger ones
+	// fail with ErrValueTooLarge and drop the connection. 0 disables the check.
+	// It only limits bodies buffered in memory, values read with GetStream or
+	// GetInto and ones skipped by Exists can be larger.
+	MaxResponseSize int
+	// CompressThreshold enables gzip compression of values that are at least
+	// this many bytes long, marking them with FlagCompressed. Compressed values
+	// can't be appended or prepended to. 0 disables compression.
+	CompressThreshold int
+	// Observer, if set, is called after every keyed request with its opcode,
+	// how long it took including retries and failover, and its error. A
+	// pipelined batch is reported once, with the opcode of its requests.
+	Observer func(op uint8, dur time.Duration, err error)
+	// DebugWriter, if set, gets a hex dump of every request sent and response
+	// received, for debugging the protocol. This includes authentication, so
+	// the dumps contain the password when PLAIN is used.
+	DebugWriter io.Writer
 }
 
 /*
@@ -39,6 +93,8 @@ The default values currently are:
 		TcpKeepAlive:       true,
 		TcpKeepAlivePeriod: 60 * time.Second,
 		TcpNoDelay:         true,
+		MaxValueSize:       1024 * 1024,
+		MaxResponseSize:    16 * 1024 * 1024,
 	}
 */
 func DefaultConfig() *Config {
@@ -53,5 +109,7 @@ func DefaultConfig() *Config {
 		TcpKeepAlive:       true,
 		TcpKeepAlivePeriod: 60 * time.Second,
 		TcpNoDelay:         true,
+		MaxValueSize:       1024 * 1024,
+		MaxResponseSize:    16 * 1024 * 1024,
 	}
 }
@@ -1,7 +1,10 @@
 package mc
 
 import (
+	"context"
+	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -45,7 +48,9 @@ func TestRetryFailure(t *testing.T) {
 // Test successful failover
 func TestFailoverSuccess(t *testing.T) {
 	config := DefaultConfig()
-	config.DownRetryDelay = 2 * time.Second
+	// s1 is marked down after the first loop's retry (200-300ms) and each loop
+	// sleeps 1s, so it is back up half-way between the 2nd and 3rd loop.
+	config.DownRetryDelay = 1500 * time.Millisecond
 	c := newMockableMC("s1-3,s2-1", "", "", config, newMockConn)
 
 	key := "k2" // this key hashes to s1
@@ -67,3 +72,204 @@ func TestFailoverSuccess(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 }
+
+// Test that a malformed counter value is returned as an error. The mock
+// connection responds with a value that isn't a 64bit integer.
+func TestIncrMalformed(t *testing.T) {
+	c := newMockableMC("s1-1", "", "", DefaultConfig(), newMockConn)
+
+	n, cas, err := c.Incr("k1", 1, 0, 0, 0)
+	if err != ErrMalformedResponse {
+		t.Errorf("n: %v, cas: %v", n, cas)
+		t.Fatalf("expected malformed response error: %v", err)
+	}
+}
+
+// Test failover from the last server wraps around to the first one.
+func TestFailoverWrapAround(t *testing.T) {
+	config := DefaultConfig()
+	config.RetryDelay = 0
+	c := newMockableMC("s1-1,s2-1,s3-99", "", "", config, newMockConn)
+
+	// find a key that hashes to s3
+	key := ""
+	for i := 0; ; i++ {
+		key = "k" + strconv.Itoa(i)
+		idx, _ := config.Hasher.getServerIndex(key)
+		if idx == 2 {
+			break
+		}
+	}
+
+	val, flags, cs, err := c.Get(key)
+	if err != nil {
+		t.Errorf("val: %v, flags: %v, cas: %v", val, flags, cs)
+		t.Fatalf("expected no error: %v", err)
+	}
+	expectedVal := key + ",s1,1"
+	if val != expectedVal {
+		t.Fatalf("got wrong value: %v, expected: %v", val, expectedVal)
+	}
+}
+
+// Test that transient server errors are retried with backoff and other
+// errors aren't.
+func TestRetryTransient(t *testing.T) {
+	tests := []struct {
+		statuses []uint16
+		err      error
+	}{
+		{[]uint16{StatusBusy, StatusTempFailure, StatusOK}, nil},
+		{[]uint16{StatusOutOfMemory, StatusOutOfMemory, StatusOutOfMemory}, ErrOutOfMemory},
+		{[]uint16{StatusNotFound}, ErrNotFound},
+		{[]uint16{StatusKeyExists}, ErrKeyExists},
+	}
+
+	for _, tt := range tests {
+		tc := newTestConn()
+		tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+		for i, status := range tt.statuses {
+			tc.addResponse(opGet, status, uint32(i+1), []byte{0, 0, 0, 0}, "", "")
+		}
+
+		config := DefaultConfig()
+		config.Retries = 3
+		config.RetryDelay = 20 * time.Millisecond
+		config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return tc, nil
+		}
+		c := NewMCwithConfig("test", "", "", config)
+
+		start := time.Now()
+		_, _, _, err := c.Get("foo")
+		assertEqualf(t, tt.err, err, "wrong error for %v: %v", tt.statuses, err)
+		assertEqualf(t, 0, tc.r.Len(), "not all responses consumed for %v", tt.statuses)
+		if len(tt.statuses) == 3 {
+			// 20ms and 40ms, plus jitter
+			elapsed := time.Since(start)
+			assertTruef(t, elapsed >= 60*time.Millisecond && elapsed < 200*time.Millisecond,
+				"unexpected backoff for %v: %v", tt.statuses, elapsed)
+		}
+	}
+}
+
+// Test that GetMulti returns the values from healthy servers when another
+// server fails.
+func TestGetMultiPartialFailure(t *testing.T) {
+	config := DefaultConfig()
+	config.PoolSize = 3
+	// s2 fails every request
+	c := newMockableMC("s1-1,s2-1000", "", "", config, newMockConn)
+
+	var keys []string
+	var expected []string // keys on s1
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		keys = append(keys, key)
+		s, _ := c.getServer(key)
+		if strings.HasPrefix(s.address, "s1") {
+			expected = append(expected, key)
+		}
+	}
+	assertTruef(t, len(expected) > 0 && len(expected) < len(keys),
+		"keys should be spread over both servers")
+
+	vals, err := c.GetMulti(keys)
+	assertNotEqualf(t, nil, err, "expected an error from s2")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "wrong status: %v", err)
+	assertEqualf(t, len(expected), len(vals), "wrong number of values: %v", vals)
+	for _, key := range expected {
+		assertTruef(t, strings.HasPrefix(vals[key], key+",s1,"),
+			"wrong value for %s: %s", key, vals[key])
+	}
+}
+
+// Test that Flush and NoOp reach all servers and report the first error.
+func TestAllServersFirstError(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	// only s1 fails, an error from the last server would hide it
+	c := newMockableMC("s1-1000,s2-1,s3-1", "", "", config, newMockConn)
+
+	for _, f := range []func() error{func() error { return c.Flush(0) }, c.NoOp} {
+		err := f()
+		assertNotEqualf(t, nil, err, "expected an error")
+		assertEqualf(t, StatusNetworkError, err.(*Error).Status, "wrong status: %v", err)
+	}
+	for i, s := range c.servers {
+		counter := s.conns[0].(*mockConn).counter
+		assertEqualf(t, 2, counter, "server %d not reached by both requests", i)
+	}
+}
+
+// Test that a client with a shard key sends all keys to the same server.
+func TestWithShard(t *testing.T) {
+	c := newMockableMC("s1-1,s2-1,s3-1", "", "", DefaultConfig(), newMockConn)
+	sc := c.WithShard("user:42")
+
+	var keys []string
+	servers := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		keys = append(keys, key)
+		s, _ := c.getServer(key)
+		servers[s.address] = true
+	}
+	assertTruef(t, len(servers) > 1, "keys should be spread over the servers")
+
+	vals, err := sc.GetMulti(keys)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, len(keys), len(vals), "wrong number of values: %v", vals)
+	shard, _ := c.getServer("user:42")
+	id := strings.Split(shard.address, "-")[0]
+	for _, key := range keys {
+		assertTruef(t, strings.HasPrefix(vals[key], key+","+id+","),
+			"%s not on the shard's server: %s", key, vals[key])
+	}
+}
+
+// Test ServerAddress follows failover.
+func TestServerAddress(t *testing.T) {
+	c := newMockableMC("s1-1,s2-1", "", "", DefaultConfig(), newMockConn)
+
+	addr, err := c.ServerAddress("foo")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	s, _ := c.getServer("foo")
+	assertEqualf(t, s.address, addr, "wrong address")
+
+	s.changeAlive(false)
+	addr2, err := c.ServerAddress("foo")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertNotEqualf(t, addr, addr2, "address should have moved to the other server")
+}
+
+// Test that without failover a server is only marked down after several
+// failures in a row, fails fast while down and is retried after the delay.
+func TestFailureThreshold(t *testing.T) {
+	config := DefaultConfig()
+	config.Retries = 1
+	config.Failover = false
+	config.FailureThreshold = 3
+	config.DownRetryDelay = 100 * time.Millisecond
+	// s1 fails all but every 1000th request
+	c := newMockableMC("s1-1000", "", "", config, newMockConn)
+	mc := c.servers[0].conns[0].(*mockConn)
+
+	for i := 1; i <= 3; i++ {
+		_, _, _, err := c.Get("k1")
+		assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a network error: %v", err)
+		assertEqualf(t, i == 3, len(c.DownServers()) == 1, "wrong down servers after %d failures: %v",
+			i, c.DownServers())
+	}
+
+	_, _, _, err := c.Get("k1")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a network error: %v", err)
+	assertEqualf(t, 3, mc.counter, "request to a down server shouldn't reach it")
+
+	// back up, but a single failure marks it down again
+	time.Sleep(150 * time.Millisecond)
+	assertEqualf(t, 0, len(c.DownServers()), "server should be back up")
+	c.Get("k1")
+	assertEqualf(t, 4, mc.counter, "request should have reached the server")
+	assertEqualf(t, []string{"s1-1000:11211"}, c.DownServers(), "server should be down again")
+}
@@ -3,8 +3,11 @@ package mc
 //
 
 import (
-	"hash"
+	"crypto/md5"
+	"encoding/binary"
 	"hash/fnv"
+	"sort"
+	"strconv"
 )
 
 type hasher interface {
@@ -14,11 +17,10 @@ type hasher interface {
 
 type moduloHasher struct {
 	nServers uint
-	h32      hash.Hash32
 }
 
 func NewModuloHasher() hasher {
-	var h hasher = &moduloHasher{h32: fnv.New32a()}
+	var h hasher = &moduloHasher{}
 	return h
 }
 
@@ -31,8 +33,97 @@ func (h *moduloHasher) getServerIndex(key string) (uint, error) {
 		return 0, &Error{StatusNetworkError, "No server available", nil}
 	}
 
-	h.h32.Write([]byte(key))
-	defer h.h32.Reset()
+	// a hash per call, the client may be used from many goroutines
+	h32 := fnv.New32a()
+	h32.Write([]byte(key))
+	return uint(h32.Sum32()) % h.nServers, nil
+}
+
+// Number of points each server gets on the consistent hashing ring. Every md5
+// digest gives four points, like ketama.
+const consistentPointsPerServer = 160
+
+type consistentHasher struct {
+	pointsPerServer int
+	weights         map[string]int // by server address, 1 if missing
+	points          []ringPoint
+}
+
+// ringPoint is a point on the consistent hashing ring owned by a server.
+type ringPoint struct {
+	hash  uint32
+	index uint
+}
+
+// NewConsistentHasher returns a ketama style consistent hasher. Each server is
+// placed on a ring at many points and a key belongs to the server owning the
+// next point on the ring, so adding or removing a server only remaps about 1/n
+// of the keys.
+func NewConsistentHasher() hasher {
+	return NewConsistentHasherWithPoints(consistentPointsPerServer)
+}
+
+// NewConsistentHasherWithPoints returns a consistent hasher placing each
+// server at pointsPerServer points on the ring, rounded up to a multiple of
+// four. More points spread the keys more evenly over the servers, at the cost
+// of memory and a slower update of the ring.
+func NewConsistentHasherWithPoints(pointsPerServer int) hasher {
+	if pointsPerServer < 1 {
+		pointsPerServer = 1
+	}
+	var h hasher = &consistentHasher{pointsPerServer: pointsPerServer}
+	return h
+}
 
-	return uint(h.h32.Sum32()) % h.nServers, nil
+// NewWeightedConsistentHasher returns a consistent hasher where each server
+// gets a share of the keys proportional to its weight, e.g. to its memory.
+// weights is keyed by server address as host:port, like the keys returned by
+// Stats, servers missing from it have weight 1 and servers with weight 0 get
+// no keys.
+func NewWeightedConsistentHasher(weights map[string]int) hasher {
+	var h hasher = &consistentHasher{
+		pointsPerServer: consistentPointsPerServer,
+		weights:         weights,
+	}
+	return h
+}
+
+func (h *consistentHasher) update(servers []*server) {
+	digests := (h.pointsPerServer + 3) / 4
+	points := make([]ringPoint, 0, len(servers)*digests*4)
+	for i, s := range servers {
+		n := digests
+		if w, ok := h.weights[s.address]; ok && w >= 0 {
+			n *= w
+		}
+		for j := 0; j < n; j++ {
+			d := md5.Sum([]byte(s.address + "-" + strconv.Itoa(j)))
+			for k := 0; k < 4; k++ {
+				points = append(points, ringPoint{
+					hash:  binary.LittleEndian.Uint32(d[k*4:]),
+					index: uint(i),
+				})
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	h.points = points
+}
+
+func (h *consistentHasher) getServerIndex(key string) (uint, error) {
+	if len(h.points) < 1 {
+		return 0, &Error{StatusNetworkError, "No server available", nil}
+	}
+
+	d := md5.Sum([]byte(key))
+	hv := binary.LittleEndian.Uint32(d[:4])
+	i := sort.Search(len(h.points), func(i int) bool {
+		return h.points[i].hash >= hv
+	})
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.points[i].index, nil
 }
@@ -0,0 +1,103 @@
+package mc
+
+import (
+	"strconv"
+	"testing"
+)
+
+func testServers(n int) []*server {
+	var servers []*server
+	for i := 0; i < n; i++ {
+		servers = append(servers, &server{address: "10.0.0." + strconv.Itoa(i) + ":11211"})
+	}
+	return servers
+}
+
+// Test that adding a server to a consistent hasher only remaps keys to the new
+// server, and only about 1/n of them.
+func TestConsistentHasherRemap(t *testing.T) {
+	const (
+		NServers = 4
+		NKeys    = 10000
+	)
+
+	h := NewConsistentHasher()
+	h.update(testServers(NServers))
+	before := make([]uint, NKeys)
+	for i := range before {
+		idx, err := h.getServerIndex("key-" + strconv.Itoa(i))
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		before[i] = idx
+	}
+
+	h.update(testServers(NServers + 1))
+	moved := 0
+	for i := range before {
+		idx, err := h.getServerIndex("key-" + strconv.Itoa(i))
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		if idx != before[i] {
+			assertEqualf(t, uint(NServers), idx,
+				"key %d moved between old servers (%d -> %d)", i, before[i], idx)
+			moved++
+		}
+	}
+
+	// expect about 1/5 of the keys to move
+	assertTruef(t, moved > NKeys/10 && moved < NKeys*3/10,
+		"unexpected number of remapped keys: %d of %d", moved, NKeys)
+}
+
+func TestConsistentHasherNoServers(t *testing.T) {
+	h := NewConsistentHasher()
+	h.update(nil)
+	_, err := h.getServerIndex("foo")
+	assertNotEqualf(t, nil, err, "expected an error without servers")
+}
+
+// Test that keys are spread evenly over the servers, and that the number of
+// points per server can be changed.
+func TestConsistentHasherDistribution(t *testing.T) {
+	const (
+		NServers = 5
+		NKeys    = 50000
+	)
+
+	for _, points := range []int{consistentPointsPerServer, 400} {
+		h := NewConsistentHasherWithPoints(points)
+		h.update(testServers(NServers))
+		assertEqualf(t, NServers*points, len(h.(*consistentHasher).points),
+			"wrong number of points on the ring")
+
+		counts := make([]int, NServers)
+		for i := 0; i < NKeys; i++ {
+			idx, err := h.getServerIndex("key-" + strconv.Itoa(i))
+			assertEqualf(t, nil, err, "unexpected error: %v", err)
+			counts[idx]++
+		}
+		// each server should get within 25% of its fair share
+		for i, n := range counts {
+			assertTruef(t, n > NKeys/NServers*3/4 && n < NKeys/NServers*5/4,
+				"server %d got %d of %d keys with %d points: %v", i, n, NKeys, points, counts)
+		}
+	}
+}
+
+// Test that servers get keys in proportion to their weights.
+func TestWeightedConsistentHasher(t *testing.T) {
+	const NKeys = 50000
+
+	servers := testServers(3)
+	h := NewWeightedConsistentHasher(map[string]int{servers[0].address: 2})
+	h.update(servers)
+
+	counts := make([]int, len(servers))
+	for i := 0; i < NKeys; i++ {
+		idx, err := h.getServerIndex("key-" + strconv.Itoa(i))
+		assertEqualf(t, nil, err, "unexpected error: %v", err)
+		counts[idx]++
+	}
+	// shares of 1/2, 1/4 and 1/4
+	ratio := float64(counts[0]) / float64(counts[1]+counts[2]) * 2
+	assertTruef(t, ratio > 1.6 && ratio < 2.4,
+		"2x weighted server got %.2f times the keys of the others: %v", ratio, counts)
+}
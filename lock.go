@@ -0,0 +1,52 @@
+package mc
+
+// Simple distributed locks built on Add.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Lock is a lock held in the cache, see AcquireLock.
+type Lock struct {
+	c     *Client
+	key   string
+	token string
+}
+
+// AcquireLock tries to take the lock named key by adding a random token under
+// it, expiring after ttl so a crashed holder can't keep it forever. acquired is
+// false without an error if someone else holds the lock.
+func (c *Client) AcquireLock(key string, ttl uint32) (lock *Lock, acquired bool, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return nil, false, wrapError(StatusUnknownError, err)
+	}
+	token := hex.EncodeToString(b)
+
+	acquired, err = c.SetNX(key, token, 0, ttl)
+	if !acquired {
+		return nil, false, err
+	}
+	return &Lock{c, key, token}, true, nil
+}
+
+// Release releases the lock. If the lock expired, and maybe was acquired by
+// someone else since, it is left alone and ErrLockLost is returned. The token
+// is checked and deleted with its CAS, so a lock taken over in between isn't
+// released either.
+func (l *Lock) Release() error {
+	token, _, cas, err := l.c.Get(l.key)
+	if err == ErrNotFound || (err == nil && token != l.token) {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+
+	err = l.c.DelCAS(l.key, cas)
+	if err == ErrCASConflict || err == ErrNotFound {
+		return ErrLockLost
+	}
+	return err
+}
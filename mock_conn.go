@@ -3,6 +3,8 @@ package mc
 // Mocks the connection between the client and memcached servers.
 
 import (
+	"context"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -52,6 +54,33 @@ func (mc *mockConn) performStats(m *msg) (McStats, error) {
 	return nil, nil
 }
 
+func (mc *mockConn) performMulti(ms []*msg) error {
+	for _, m := range ms {
+		err := mc.perform(m)
+		if err != nil {
+			return err
+		}
+		m.Magic = magicRecv
+	}
+	return nil
+}
+
+func (mc *mockConn) setStream(m *msg, size int) (io.WriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (mc *mockConn) getStream(m *msg) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (mc *mockConn) open(ctx context.Context) error {
+	return nil
+}
+
+func (mc *mockConn) traffic() (sent, recvd uint64) {
+	return 0, 0
+}
+
 func (mc *mockConn) quit(m *msg) {
 }
 
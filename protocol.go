@@ -2,6 +2,11 @@ package mc
 
 // Deal with the protocol specification of Memcached.
 
+import (
+	"context"
+	"fmt"
+)
+
 // Error represents a MemCache error (including the status code). All function
 // in mc return error values of this type, despite the functions using the plain
 // error type. You can safely cast all error types returned by mc to *Error. If
@@ -24,37 +29,58 @@ func (err Error) Error() string {
 
 // Errors mc may return. Some errors aren't represented here as the message is
 // dynamically generated. Status Code however captures all possible values for
-// Error.Status.
+// Error.Status. ErrUnknownError is only returned for StatusUnknownError, other
+// statuses mc doesn't know get an Error of their own that keeps the status, so
+// compare Status rather than against ErrUnknownError to catch those.
 var (
 	ErrNotFound       = &Error{StatusNotFound, "mc: not found", nil}
 	ErrKeyExists      = &Error{StatusKeyExists, "mc: key exists", nil}
-	ErrValueTooLarge  = &Error{StatusValueNotStored, "mc: value to large", nil}
+	ErrCASConflict    = &Error{StatusKeyExists, "mc: CAS mismatch", nil}
+	ErrValueTooLarge  = &Error{StatusValueTooLarge, "mc: value to large", nil}
 	ErrInvalidArgs    = &Error{StatusInvalidArgs, "mc: invalid arguments", nil}
 	ErrValueNotStored = &Error{StatusValueNotStored, "mc: value not stored", nil}
 	ErrNonNumeric     = &Error{StatusNonNumeric, "mc: incr/decr called on non-numeric value", nil}
+	ErrNotMyVBucket   = &Error{StatusNotMyVBucket, "mc: vbucket belongs to another server", nil}
 	ErrAuthRequired   = &Error{StatusAuthRequired, "mc: authentication required", nil}
-	ErrAuthContinue   = &Error{StatusAuthContinue, "mc: authentication continue (unsupported)", nil}
+	ErrAuthFailed     = &Error{StatusAuthRequired, "mc: authentication failed", nil}
+	ErrAuthContinue   = &Error{StatusAuthContinue, "mc: authentication continue", nil}
 	ErrUnknownCommand = &Error{StatusUnknownCommand, "mc: unknown command", nil}
 	ErrOutOfMemory    = &Error{StatusOutOfMemory, "mc: out of memory", nil}
+	ErrNotSupported   = &Error{StatusNotSupported, "mc: not supported", nil}
+	ErrInternalError  = &Error{StatusInternalError, "mc: internal error in server", nil}
+	ErrBusy           = &Error{StatusBusy, "mc: server busy", nil}
+	ErrTempFailure    = &Error{StatusTempFailure, "mc: temporary failure in server", nil}
 	ErrUnknownError   = &Error{StatusUnknownError, "mc: unknown error from server", nil}
+
+	ErrMalformedResponse = &Error{StatusMalformedResponse, "mc: malformed response from server", nil}
+	ErrCodecMismatch     = &Error{StatusInvalidArgs, "mc: value wasn't stored with this codec", nil}
+	ErrLockLost          = &Error{StatusNotFound, "mc: lock expired or taken over", nil}
+	ErrVersionMismatch   = &Error{StatusNotFound, "mc: value was stored with another version", nil}
 )
 
 // Status Codes that may be returned (usually as part of an Error).
 const (
-	StatusOK             = uint16(0)
-	StatusNotFound       = uint16(1)
-	StatusKeyExists      = uint16(2)
-	StatusValueTooLarge  = uint16(3)
-	StatusInvalidArgs    = uint16(4)
-	StatusValueNotStored = uint16(5)
-	StatusNonNumeric     = uint16(6)
-	StatusAuthRequired   = uint16(0x20)
-	StatusAuthContinue   = uint16(0x21)
-	StatusUnknownCommand = uint16(0x81)
-	StatusOutOfMemory    = uint16(0x82)
-	StatusAuthUnknown    = uint16(0xffff)
-	StatusNetworkError   = uint16(0xfff1)
-	StatusUnknownError   = uint16(0xffff)
+	StatusOK                = uint16(0)
+	StatusNotFound          = uint16(1)
+	StatusKeyExists         = uint16(2)
+	StatusValueTooLarge     = uint16(3)
+	StatusInvalidArgs       = uint16(4)
+	StatusValueNotStored    = uint16(5)
+	StatusNonNumeric        = uint16(6)
+	StatusNotMyVBucket      = uint16(7)
+	StatusAuthRequired      = uint16(0x20)
+	StatusAuthContinue      = uint16(0x21)
+	StatusUnknownCommand    = uint16(0x81)
+	StatusOutOfMemory       = uint16(0x82)
+	StatusNotSupported      = uint16(0x83)
+	StatusInternalError     = uint16(0x84)
+	StatusBusy              = uint16(0x85)
+	StatusTempFailure       = uint16(0x86)
+	StatusAuthUnknown       = uint16(0xffff)
+	StatusNetworkError      = uint16(0xfff1)
+	StatusMalformedResponse = uint16(0xfff2)
+	StatusContextError      = uint16(0xfff3)
+	StatusUnknownError      = uint16(0xffff)
 )
 
 // newError takes a status from the server and creates a matching Error.
@@ -74,19 +100,31 @@ func newError(status uint16) error {
 		return ErrValueNotStored
 	case StatusNonNumeric:
 		return ErrNonNumeric
+	case StatusNotMyVBucket:
+		return ErrNotMyVBucket
 	case StatusAuthRequired:
 		return ErrAuthRequired
 
-	// we only support PLAIN auth, no mechanism that would make use of auth
-	// continue, so make it an error for now for completeness.
+	// auth continue is only sent during SASL authentication, where it is
+	// handled, so make it an error otherwise for completeness.
 	case StatusAuthContinue:
 		return ErrAuthContinue
 	case StatusUnknownCommand:
 		return ErrUnknownCommand
 	case StatusOutOfMemory:
 		return ErrOutOfMemory
+	case StatusNotSupported:
+		return ErrNotSupported
+	case StatusInternalError:
+		return ErrInternalError
+	case StatusBusy:
+		return ErrBusy
+	case StatusTempFailure:
+		return ErrTempFailure
+	case StatusUnknownError:
+		return ErrUnknownError
 	}
-	return ErrUnknownError
+	return &Error{status, fmt.Sprintf("mc: unknown status %d from server", status), nil}
 }
 
 // wrapError wraps an existing error in an Error value.
@@ -148,13 +186,19 @@ const (
 	magicRecv magicCode = 0x81
 )
 
+// Data types of values, for servers that support them (memcached doesn't).
+const (
+	DataTypeRaw  = uint8(0)
+	DataTypeJSON = uint8(1)
+)
+
 // Memcache header
 type header struct {
 	Magic        magicCode
 	Op           opCode
 	KeyLen       uint16
 	ExtraLen     uint8
-	DataType     uint8  // not used, memcached expects it to be 0x00.
+	DataType     uint8  // DataTypeRaw unless set by SetWithDataType.
 	ResvOrStatus uint16 // for request this field is reserved / unused, for
 	// response it indicates the status
 	BodyLen uint32
@@ -170,9 +214,30 @@ type msg struct {
 	// Idea of this is we can pass in pointers to values that should appear in the
 	// response extras in this field and the generic send/receive code can handle.
 	oextras []interface{} // [24..(m-1)] Command specifc extras (Out)
+	rextras []byte        // raw response extras, only kept for Client.Do
 
 	key string // [m..(n-1)] Key (as needed, length in header)
 	val string // [n..x] Value (as needed, length in header)
+
+	// keyless allows an empty key, which is then sent without a prefix, for
+	// requests from Client.Do that don't take one.
+	keyless bool
+	// discardVal makes the response value be skipped instead of stored in val.
+	discardVal bool
+	// dst, if set, gets the response value copied into it instead of val, if
+	// it fits.
+	dst []byte
+
+	// ctx optionally bounds the request, it isn't sent to the server.
+	ctx context.Context
+}
+
+// context returns the context bounding the request.
+func (m *msg) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
 }
 
 // Memcache stats
@@ -0,0 +1,43 @@
+package mc
+
+import (
+	"testing"
+)
+
+// Test that every status the server may send maps to an error with the same
+// status.
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		status uint16
+		err    error
+	}{
+		{StatusOK, nil},
+		{StatusNotFound, ErrNotFound},
+		{StatusKeyExists, ErrKeyExists},
+		{StatusValueTooLarge, ErrValueTooLarge},
+		{StatusInvalidArgs, ErrInvalidArgs},
+		{StatusValueNotStored, ErrValueNotStored},
+		{StatusNonNumeric, ErrNonNumeric},
+		{StatusNotMyVBucket, ErrNotMyVBucket},
+		{StatusAuthRequired, ErrAuthRequired},
+		{StatusAuthContinue, ErrAuthContinue},
+		{StatusUnknownCommand, ErrUnknownCommand},
+		{StatusOutOfMemory, ErrOutOfMemory},
+		{StatusNotSupported, ErrNotSupported},
+		{StatusInternalError, ErrInternalError},
+		{StatusBusy, ErrBusy},
+		{StatusTempFailure, ErrTempFailure},
+	}
+
+	for _, tt := range tests {
+		err := newError(tt.status)
+		assertEqualf(t, tt.err, err, "wrong error for status %#x", tt.status)
+		if err != nil {
+			assertEqualf(t, tt.status, err.(*Error).Status,
+				"wrong status in error for status %#x", tt.status)
+		}
+	}
+
+	err := newError(0x99)
+	assertEqualf(t, uint16(0x99), err.(*Error).Status, "unknown status not kept")
+}
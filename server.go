@@ -3,6 +3,9 @@ package mc
 // Handles all server connections to a particular memcached servers.
 
 import (
+	"context"
+	"io"
+	"math/rand"
 	"net"
 	"net/url"
 	"strings"
@@ -18,8 +21,12 @@ type server struct {
 	// NOTE: organizing the pool as a chan makes the usage of the containing
 	// connections treadsafe
 	pool    chan mcConn
+	conns   []mcConn // all connections of the pool, even those in use
 	isAlive bool
-	lock    sync.Mutex
+	// failures counts the requests that failed in a row, see failed. It and
+	// isAlive are guarded by lock.
+	failures int
+	lock     sync.Mutex
 }
 
 const defaultPort = "11211"
@@ -59,7 +66,9 @@ func newServer(address, username, password string, config *Config, newMcConn con
 	}
 
 	for i := 0; i < config.PoolSize; i++ {
-		server.pool <- newMcConn(addr, scheme, username, password, config)
+		c := newMcConn(addr, scheme, username, password, config)
+		server.conns = append(server.conns, c)
+		server.pool <- c
 	}
 
 	return server
@@ -67,6 +76,10 @@ func newServer(address, username, password string, config *Config, newMcConn con
 
 func (s *server) perform(m *msg) error {
 	var err error
+	ctx := m.context()
+	if ctx.Err() != nil {
+		return wrapError(StatusContextError, ctx.Err())
+	}
 	for i := 0; ; {
 		timeout := time.After(s.config.ConnectionTimeout)
 		select {
@@ -86,9 +99,8 @@ func (s *server) perform(m *msg) error {
 			if err == nil {
 				return nil
 			}
-			// Return Memcached errors except network errors.
-			mErr := err.(*Error)
-			if mErr.Status != StatusNetworkError {
+			// Return Memcached errors except network and transient errors.
+			if !retryable(err) {
 				return err
 			}
 
@@ -97,7 +109,11 @@ func (s *server) perform(m *msg) error {
 			if i < s.config.Retries {
 				// restore request since m now contains the failed response
 				c.restore(m)
-				time.Sleep(s.config.RetryDelay)
+				select {
+				case <-time.After(s.backoff(i)):
+				case <-ctx.Done():
+					return wrapError(StatusContextError, ctx.Err())
+				}
 			} else {
 				return err
 			}
@@ -107,12 +123,35 @@ func (s *server) perform(m *msg) error {
 				"Timed out while waiting for connection from pool. " +
 					"Maybe increase your pool size?",
 				nil}
+		case <-ctx.Done():
+			return wrapError(StatusContextError, ctx.Err())
 		}
 	}
 	// return err
 }
 
 func (s *server) performStats(m *msg) (McStats, error) {
+	c, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := c.performStats(m)
+	s.pool <- c
+	return stats, err
+}
+
+func (s *server) performMulti(ms []*msg) error {
+	c, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	err = c.performMulti(ms)
+	s.pool <- c
+	return err
+}
+
+// acquire takes a connection from the pool, it must be put back once done.
+func (s *server) acquire() (mcConn, error) {
 	timeout := time.After(s.config.ConnectionTimeout)
 	select {
 	case c := <-s.pool:
@@ -120,10 +159,7 @@ func (s *server) performStats(m *msg) (McStats, error) {
 		if c == nil {
 			return nil, &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
 		}
-
-		stats, err := c.performStats(m)
-		s.pool <- c
-		return stats, err
+		return c, nil
 
 	case <-timeout:
 		// do not retry
@@ -134,6 +170,98 @@ func (s *server) performStats(m *msg) (McStats, error) {
 	}
 }
 
+// setStream starts a set whose value is streamed, see Client.SetStream. The
+// connection is held until the returned writer is closed.
+func (s *server) setStream(m *msg, size int) (io.WriteCloser, error) {
+	c, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.setStream(m, size)
+	if err != nil {
+		s.pool <- c
+		return nil, err
+	}
+	return &pooledWriter{w, pooled{w, func() { s.pool <- c }}}, nil
+}
+
+// getStream starts a get whose value is streamed, see Client.GetStream. The
+// connection is held until the returned reader is closed.
+func (s *server) getStream(m *msg) (io.ReadCloser, error) {
+	c, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.getStream(m)
+	if err != nil {
+		s.pool <- c
+		return nil, err
+	}
+	return &pooledReader{r, pooled{r, func() { s.pool <- c }}}, nil
+}
+
+// pooled closes a stream and puts its connection back into the pool, once.
+type pooled struct {
+	stream  io.Closer
+	release func()
+}
+
+func (p *pooled) Close() error {
+	if p.release == nil {
+		return nil
+	}
+	err := p.stream.Close()
+	p.release()
+	p.release = nil
+	return err
+}
+
+// pooledWriter is a streamed value writer holding a connection of the pool.
+type pooledWriter struct {
+	io.Writer
+	pooled
+}
+
+// pooledReader is a streamed value reader holding a connection of the pool.
+type pooledReader struct {
+	io.Reader
+	pooled
+}
+
+// connect opens all connections of the pool that aren't open yet.
+func (s *server) connect(ctx context.Context) error {
+	conns := make([]mcConn, 0, s.config.PoolSize)
+	defer func() {
+		for _, c := range conns {
+			s.pool <- c
+		}
+	}()
+
+	timeout := time.After(s.config.ConnectionTimeout)
+	for len(conns) < s.config.PoolSize {
+		select {
+		case c := <-s.pool:
+			if c == nil {
+				return &Error{StatusUnknownError, "Client is closed (did you call Quit?)", nil}
+			}
+			conns = append(conns, c)
+		case <-timeout:
+			return &Error{StatusUnknownError,
+				"Timed out while waiting for connection from pool. " +
+					"Maybe increase your pool size?",
+				nil}
+		}
+	}
+
+	for _, c := range conns {
+		err := c.open(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *server) quit(m *msg) {
 	for i := 0; i < s.config.PoolSize; i++ {
 		c := <-s.pool
@@ -155,3 +283,53 @@ func (s *server) changeAlive(alive bool) bool {
 	}
 	return false
 }
+
+// down reports whether the server is marked down.
+func (s *server) down() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.isAlive
+}
+
+// failed records a request that failed with a network error and marks the
+// server down once threshold requests failed in a row. It returns true if
+// this marked the server down. The count isn't reset when the server is
+// brought back up, so a single failure marks it down again until a request
+// succeeds.
+func (s *server) failed(threshold int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures++
+	if s.isAlive && s.failures >= threshold {
+		s.isAlive = false
+		return true
+	}
+	return false
+}
+
+// succeeded records a request that went through, resetting the failures.
+func (s *server) succeeded() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = 0
+}
+
+// retryable reports whether a request that failed with err may succeed if
+// tried again.
+func retryable(err error) bool {
+	switch err.(*Error).Status {
+	case StatusNetworkError, StatusBusy, StatusTempFailure, StatusOutOfMemory:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait before the next attempt after attempt
+// failed. The jitter keeps clients from retrying in lockstep.
+func (s *server) backoff(attempt int) time.Duration {
+	if attempt > 10 {
+		attempt = 10
+	}
+	d := s.config.RetryDelay << uint(attempt-1)
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
@@ -3,18 +3,31 @@ package mc
 // Handles the connection with the memcached servers.
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type mcConn interface {
 	perform(m *msg) error
 	performStats(m *msg) (McStats, error)
+	performMulti(ms []*msg) error
+	setStream(m *msg, size int) (io.WriteCloser, error)
+	getStream(m *msg) (io.ReadCloser, error)
+	traffic() (sent, recvd uint64)
+	open(ctx context.Context) error
 	quit(m *msg)
 	backup(m *msg)
 	restore(m *msg)
@@ -24,15 +37,25 @@ type connGen func(address, scheme, username, password string, config *Config) mc
 
 // serverConn is a connection to a memcache server.
 type serverConn struct {
+	// bytes sent to and received from the server, first for 64-bit alignment
+	sent      uint64
+	recvd     uint64
 	address   string
 	scheme    string
 	username  string
 	password  string
 	config    *Config
 	conn      net.Conn
+	rbuf      *bufio.Reader // buffers reads from conn
+	body      []byte        // reused for response bodies
+	lastUsed  time.Time     // time of the last request sent
 	buf       *bytes.Buffer
 	opq       uint32
 	backupMsg msg
+	// midResponse is set while a response has been partly read, resync is set
+	// when the response to an aborted request may still arrive
+	midResponse bool
+	resync      bool
 }
 
 func newServerConn(address, scheme, username, password string, config *Config) mcConn {
@@ -49,24 +72,256 @@ func newServerConn(address, scheme, username, password string, config *Config) m
 
 func (sc *serverConn) perform(m *msg) error {
 	// lazy connection
-	if sc.conn == nil {
-		err := sc.connect()
-		if err != nil {
-			return err
-		}
+	err := sc.open(m.context())
+	if err != nil {
+		return err
 	}
 	return sc.sendRecv(m)
 }
 
 func (sc *serverConn) performStats(m *msg) (McStats, error) {
 	// lazy connection
-	if sc.conn == nil {
-		err := sc.connect()
+	err := sc.open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return sc.sendRecvStats(m)
+}
+
+func (sc *serverConn) performMulti(ms []*msg) error {
+	// lazy connection
+	err := sc.open(context.Background())
+	if err != nil {
+		return err
+	}
+	return sc.sendRecvMulti(ms)
+}
+
+func (sc *serverConn) setStream(m *msg, size int) (io.WriteCloser, error) {
+	// lazy connection
+	err := sc.open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// the body length is part of the header, so the size must be known
+	sc.buf.Reset()
+	err = sc.encodeHead(m, size)
+	if err == nil {
+		err = sc.flush(context.Background())
+	}
+	if err != nil {
+		sc.resetConn(err)
+		return nil, err
+	}
+	return &valueWriter{sc: sc, m: m, left: size}, nil
+}
+
+// valueWriter streams the value of a request straight to the connection and
+// receives the response when closed.
+type valueWriter struct {
+	sc   *serverConn
+	m    *msg
+	left int // bytes of the value still to be written
+	err  error
+}
+
+func (w *valueWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(p) > w.left {
+		return 0, ErrInvalidArgs
+	}
+
+	sc := w.sc
+	sc.conn.SetWriteDeadline(sc.deadline(context.Background(), sc.writeTimeout()))
+	sc.debug("sent", p)
+	n, err := sc.conn.Write(p)
+	atomic.AddUint64(&sc.sent, uint64(n))
+	w.left -= n
+	if err != nil {
+		w.err = wrapError(StatusNetworkError, err)
+		sc.resetConn(w.err)
+	}
+	return n, w.err
+}
+
+func (w *valueWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.left > 0 {
+		// the server is still waiting for the rest of the value, there is no
+		// way to cancel the request
+		w.err = ErrInvalidArgs
+		w.sc.conn.Close()
+		w.sc.conn = nil
+		return w.err
+	}
+
+	w.err = w.sc.recv(w.m)
+	if w.err != nil {
+		w.sc.resetConn(w.err)
+	}
+	return w.err
+}
+
+func (sc *serverConn) getStream(m *msg) (io.ReadCloser, error) {
+	// lazy connection
+	err := sc.open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	err = sc.send(m)
+	if err == nil {
+		err = sc.recvHead(m)
+	}
+	if err != nil {
+		sc.resetConn(err)
+		return nil, err
+	}
+	vlen := int(m.BodyLen) - int(m.ExtraLen) - int(m.KeyLen)
+	if vlen == 0 {
+		sc.midResponse = false
+	}
+	return &valueReader{sc: sc, left: vlen}, nil
+}
+
+// recvHead receives a response up to its value, which is left to be read off
+// the connection. Error responses are received completely.
+func (sc *serverConn) recvHead(m *msg) error {
+	opaque := m.Opaque
+	err := sc.recvHeader(context.Background(), &m.header)
+	if err != nil {
+		return err
+	}
+	if m.Opaque != opaque {
+		return ErrMalformedResponse
+	}
+	if m.ResvOrStatus != StatusOK {
+		return sc.recvBody(m)
+	}
+
+	hd := make([]byte, int(m.ExtraLen)+int(m.KeyLen))
+	_, err = io.ReadFull(sc.rbuf, hd)
+	if err != nil {
+		return wrapError(StatusNetworkError, err)
+	}
+	atomic.AddUint64(&sc.recvd, uint64(len(hd)))
+	sc.debug("received body head", hd)
+
+	if int(m.ExtraLen) < sizeOfOutExtras(m.oextras) {
+		return ErrMalformedResponse
+	}
+	buf := bytes.NewBuffer(hd)
+	for _, e := range m.oextras {
+		err := binary.Read(buf, binary.BigEndian, e)
 		if err != nil {
-			return nil, err
+			return wrapError(StatusNetworkError, err)
 		}
 	}
-	return sc.sendRecvStats(m)
+	m.key = string(hd[m.ExtraLen:])
+	return nil
+}
+
+// valueReader reads the value of a response straight off the connection.
+// Closing it skips whatever is left of the value.
+type valueReader struct {
+	sc   *serverConn
+	left int // bytes of the value still to be read
+	err  error
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > r.left {
+		p = p[:r.left]
+	}
+
+	sc := r.sc
+	sc.conn.SetReadDeadline(sc.deadline(context.Background(), sc.readTimeout()))
+	n, err := sc.rbuf.Read(p)
+	atomic.AddUint64(&sc.recvd, uint64(n))
+	sc.debug("received body", p[:n])
+	r.left -= n
+	if err != nil {
+		r.err = wrapError(StatusNetworkError, err)
+		sc.resetConn(r.err)
+		return n, r.err
+	}
+	if r.left == 0 {
+		sc.midResponse = false
+	}
+	return n, nil
+}
+
+func (r *valueReader) Close() error {
+	if r.err != nil || r.left == 0 {
+		return nil
+	}
+	sc := r.sc
+	sc.conn.SetReadDeadline(sc.deadline(context.Background(), sc.readTimeout()))
+	n, err := io.CopyN(ioutil.Discard, sc.rbuf, int64(r.left))
+	atomic.AddUint64(&sc.recvd, uint64(n))
+	r.left -= int(n)
+	if err != nil {
+		r.err = wrapError(StatusNetworkError, err)
+		sc.resetConn(r.err)
+		return r.err
+	}
+	sc.midResponse = false
+	return nil
+}
+
+// idleCheck is how long a connection must have been idle before it is checked
+// for having been closed by the server before being used.
+const idleCheck = time.Second
+
+// open connects to the server unless already connected. A connection that
+// was idle for a while and found to be closed on the other end is replaced.
+func (sc *serverConn) open(ctx context.Context) error {
+	if sc.conn != nil && sc.resync && !sc.skipStale() {
+		sc.close()
+	}
+	if sc.conn != nil && time.Since(sc.lastUsed) > idleCheck && !sc.alive() {
+		sc.conn.Close()
+		sc.conn = nil
+	}
+	if sc.conn != nil {
+		return nil
+	}
+	return sc.connect(ctx)
+}
+
+// alive checks whether an idle connection is still open without sending
+// anything, by reading with a very short deadline. That times out if the
+// connection is open and nothing was sent, and returns EOF straight away if
+// the server closed it. (A deadline in the past would time out without even
+// trying to read.) Data from the server while idle means we are out of sync,
+// so the connection can't be used either.
+func (sc *serverConn) alive() bool {
+	if sc.rbuf.Buffered() > 0 {
+		return false
+	}
+	sc.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := sc.rbuf.Peek(1)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// traffic returns the number of bytes sent and received over the lifetime of
+// the serverConn.
+func (sc *serverConn) traffic() (sent, recvd uint64) {
+	return atomic.LoadUint64(&sc.sent), atomic.LoadUint64(&sc.recvd)
 }
 
 func (sc *serverConn) quit(m *msg) {
@@ -80,24 +335,53 @@ func (sc *serverConn) quit(m *msg) {
 	}
 }
 
-func (sc *serverConn) connect() error {
-	c, err := net.DialTimeout(sc.scheme, sc.address, sc.config.ConnectionTimeout)
-	if err != nil {
-		return wrapError(StatusNetworkError, err)
+// connect dials the server and authenticates. The connection timeout bounds
+// the whole sequence, not each step, so a slow authentication can't hang a
+// request for several timeouts. Running out of it is a network error, unlike
+// ctx being done.
+func (sc *serverConn) connect(ctx context.Context) error {
+	if sc.config.ConnectionTimeout <= 0 {
+		return sc.dialAuth(ctx)
 	}
-	sc.conn = c
-	if sc.scheme == "tcp" {
-		tcpConn, ok := c.(*net.TCPConn)
-		if !ok {
-			return &Error{StatusNetworkError, "Cannot convert into TCP connection", nil}
+	cctx, cancel := context.WithTimeout(ctx, sc.config.ConnectionTimeout)
+	defer cancel()
+	err := sc.dialAuth(cctx)
+	if err != nil && ctx.Err() == nil {
+		if mErr := err.(*Error); mErr.Status == StatusContextError {
+			return wrapError(StatusNetworkError, mErr.WrappedError)
 		}
+	}
+	return err
+}
 
+// dialAuth opens a connection to the server and authenticates on it.
+func (sc *serverConn) dialAuth(ctx context.Context) error {
+	dial := sc.config.DialContext
+	if dial == nil {
+		dialer := net.Dialer{Timeout: sc.config.ConnectionTimeout}
+		dial = dialer.DialContext
+	}
+	c, err := dial(ctx, sc.scheme, sc.address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return wrapError(StatusContextError, ctx.Err())
+		}
+		return wrapError(StatusNetworkError, err)
+	}
+	if tcpConn, ok := c.(*net.TCPConn); ok {
 		tcpConn.SetKeepAlive(sc.config.TcpKeepAlive)
 		tcpConn.SetKeepAlivePeriod(sc.config.TcpKeepAlivePeriod)
 		tcpConn.SetNoDelay(sc.config.TcpNoDelay)
 	}
+	if sc.config.TLSConfig != nil {
+		c, err = sc.handshake(ctx, c)
+		if err != nil {
+			return err
+		}
+	}
+	sc.setConn(c)
 	// authenticate
-	err = sc.auth()
+	err = sc.auth(ctx)
 	if err != nil {
 		// Error, except if the server doesn't support authentication
 		mErr := err.(*Error)
@@ -112,16 +396,63 @@ func (sc *serverConn) connect() error {
 	return nil
 }
 
-// Auth performs SASL authentication (using the PLAIN method) with the server.
-func (sc *serverConn) auth() error {
-	s, err := sc.authList()
+// handshake wraps c in a TLS client connection and performs the handshake,
+// bounded by the connection timeout and ctx.
+func (sc *serverConn) handshake(ctx context.Context, c net.Conn) (net.Conn, error) {
+	config := sc.config.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(sc.address)
+		if err != nil {
+			host = sc.address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(c, config)
+	c.SetDeadline(sc.deadline(ctx, sc.config.ConnectionTimeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, wrapError(StatusContextError, ctx.Err())
+		}
+		return nil, wrapError(StatusNetworkError, err)
+	}
+	c.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// setConn makes the connection c the one used to talk to the server.
+func (sc *serverConn) setConn(c net.Conn) {
+	sc.conn = c
+	sc.lastUsed = time.Now()
+	sc.midResponse = false
+	sc.resync = false
+	if sc.rbuf == nil {
+		sc.rbuf = bufio.NewReader(c)
+	} else {
+		sc.rbuf.Reset(c)
+	}
+}
+
+// Auth performs SASL authentication with the server. CRAM-MD5 is used if the
+// server supports it, PLAIN otherwise.
+func (sc *serverConn) auth(ctx context.Context) error {
+	s, err := sc.authList(ctx)
 	if err != nil {
 		return err
 	}
 
+	mechs := make(map[string]bool)
+	for _, mech := range strings.Fields(s) {
+		mechs[mech] = true
+	}
 	switch {
-	case strings.Index(s, "PLAIN") != -1:
-		return sc.authPlain()
+	case mechs["CRAM-MD5"]:
+		return sc.authCRAMMD5(ctx)
+	case mechs["PLAIN"]:
+		return sc.authPlain(ctx)
 	}
 
 	return &Error{StatusAuthUnknown, fmt.Sprintf("mc: unknown auth types %q", s), nil}
@@ -129,11 +460,12 @@ func (sc *serverConn) auth() error {
 
 // authList runs the SASL authentication list command with the server to
 // retrieve the list of support authentication mechanisms.
-func (sc *serverConn) authList() (string, error) {
+func (sc *serverConn) authList(ctx context.Context) (string, error) {
 	m := &msg{
 		header: header{
 			Op: opAuthList,
 		},
+		ctx: ctx,
 	}
 
 	err := sc.sendRecv(m)
@@ -141,35 +473,219 @@ func (sc *serverConn) authList() (string, error) {
 }
 
 // authPlain performs SASL authentication using the PLAIN method.
-func (sc *serverConn) authPlain() error {
+func (sc *serverConn) authPlain(ctx context.Context) error {
+	return sc.authSASL(ctx, "PLAIN", fmt.Sprintf("\x00%s\x00%s", sc.username, sc.password), nil)
+}
+
+// authCRAMMD5 performs SASL authentication using the CRAM-MD5 method. The
+// server responds to the start request with a challenge (and an auth continue
+// status), which we answer with the user name and the HMAC-MD5 digest of the
+// challenge keyed by the password.
+func (sc *serverConn) authCRAMMD5(ctx context.Context) error {
+	answered := false
+	return sc.authSASL(ctx, "CRAM-MD5", "", func(challenge string) (string, error) {
+		if answered {
+			// there is only one challenge
+			return "", ErrAuthContinue
+		}
+		answered = true
+		mac := hmac.New(md5.New, []byte(sc.password))
+		mac.Write([]byte(challenge))
+		return sc.username + " " + hex.EncodeToString(mac.Sum(nil)), nil
+	})
+}
+
+// authSASL runs a SASL exchange for mech. It starts with the initial response
+// and, for as long as the server answers with an auth continue status, sends
+// the response step computes for the server's challenge. Mechanisms that
+// complete in one step pass a nil step.
+func (sc *serverConn) authSASL(ctx context.Context, mech, initial string, step func(challenge string) (string, error)) error {
 	m := &msg{
 		header: header{
 			Op: opAuthStart,
 		},
 
-		key: "PLAIN",
-		val: fmt.Sprintf("\x00%s\x00%s", sc.username, sc.password),
+		key: mech,
+		val: initial,
+		ctx: ctx,
 	}
 
-	return sc.sendRecv(m)
+	err := sc.sendRecv(m)
+	for err == ErrAuthContinue && step != nil {
+		resp, serr := step(m.val)
+		if serr != nil {
+			return serr
+		}
+		m = &msg{
+			header: header{
+				Op: opAuthStep,
+			},
+
+			key: mech,
+			val: resp,
+			ctx: ctx,
+		}
+		err = sc.sendRecv(m)
+	}
+	return authError(err)
+}
+
+// authError tells bad credentials apart from other errors. The server answers a
+// failed authentication with the same status it uses to reject requests that
+// require authentication.
+func authError(err error) error {
+	if err == ErrAuthRequired {
+		return ErrAuthFailed
+	}
+	return err
 }
 
 // sendRecv sends and receives a complete memcache request/response exchange.
 func (sc *serverConn) sendRecv(m *msg) error {
+	ctx := m.context()
+	stop := sc.watchContext(ctx)
 	err := sc.send(m)
-	if err != nil {
-		sc.resetConn(err)
-		return err
+	sent := err == nil
+	if sent {
+		err = sc.recv(m)
 	}
-	err = sc.recv(m)
+	stop()
 	if err != nil {
-		sc.resetConn(err)
-		return err
+		if sent && !sc.midResponse && isTimeout(err) {
+			// aborted while waiting for the response, the connection is still
+			// in sync up to it, so skip it when next used rather than close
+			sc.resync = true
+		} else {
+			sc.resetConn(err)
+		}
+		return contextError(ctx, err)
 	}
 	return nil
 }
 
-// sendRecvStats
+// isTimeout reports whether err is a network timeout, which includes requests
+// aborted by their context.
+func isTimeout(err error) bool {
+	ne, ok := err.(*Error).WrappedError.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// skipStale brings the connection back in sync after an aborted request by
+// sending a NOOP and discarding all responses up to the one with its opaque.
+// It returns false if that fails, and the connection has to be dropped.
+func (sc *serverConn) skipStale() bool {
+	sc.resync = false
+	noop := &msg{
+		header: header{
+			Op: opNoop,
+		},
+	}
+
+	ctx := context.Background()
+	sc.buf.Reset()
+	if sc.encode(noop) != nil || sc.flush(ctx) != nil {
+		return false
+	}
+	for {
+		m := &msg{discardVal: true}
+		if sc.recvHeader(ctx, &m.header) != nil {
+			return false
+		}
+		err := sc.recvBody(m)
+		if err != nil && err.(*Error).Status == StatusNetworkError {
+			return false
+		}
+		if m.Opaque == noop.Opaque {
+			return true
+		}
+	}
+}
+
+// watchContext aborts any blocked read or write on the connection once ctx is
+// done. The returned function must be called once the exchange is over.
+func (sc *serverConn) watchContext(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		// can never be done
+		return func() {}
+	}
+
+	conn := sc.conn
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// contextError replaces a network error caused by ctx being done with an error
+// carrying the context error.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil && err.(*Error).Status == StatusNetworkError {
+		return wrapError(StatusContextError, ctx.Err())
+	}
+	return err
+}
+
+// debug hex dumps data sent to or received from the server to the
+// DebugWriter, if any.
+func (sc *serverConn) debug(what string, b []byte) {
+	if sc.config.DebugWriter == nil {
+		return
+	}
+	fmt.Fprintf(sc.config.DebugWriter, "mc: %s %s (%d bytes)\n%s", sc.address, what, len(b), hex.Dump(b))
+}
+
+// deadline returns the deadline for the next read or write of a request
+// bounded by timeout and ctx. Once ctx is done, that is now.
+func (sc *serverConn) deadline(ctx context.Context, timeout time.Duration) time.Time {
+	if ctx.Err() != nil {
+		return time.Now()
+	}
+	d := time.Now().Add(timeout)
+	if ctxd, ok := ctx.Deadline(); ok && ctxd.Before(d) {
+		return ctxd
+	}
+	return d
+}
+
+// setDeadline sets a read or write deadline with set, see deadline. ctx may be
+// done while it is set, overwriting the deadline watchContext set to abort the
+// request, so ctx is checked again afterwards.
+func (sc *serverConn) setDeadline(ctx context.Context, set func(time.Time) error, timeout time.Duration) {
+	set(sc.deadline(ctx, timeout))
+	if ctx.Err() != nil {
+		set(time.Now())
+	}
+}
+
+// readTimeout returns the timeout for reading a response.
+func (sc *serverConn) readTimeout() time.Duration {
+	if sc.config.ReadTimeout > 0 {
+		return sc.config.ReadTimeout
+	}
+	return sc.config.ConnectionTimeout
+}
+
+// writeTimeout returns the timeout for sending a request.
+func (sc *serverConn) writeTimeout() time.Duration {
+	if sc.config.WriteTimeout > 0 {
+		return sc.config.WriteTimeout
+	}
+	return sc.config.ConnectionTimeout
+}
+
+// sendRecvStats sends a stats request and collects the stream of key/value
+// responses until the terminating response without a key arrives.
 func (sc *serverConn) sendRecvStats(m *msg) (stats McStats, err error) {
 	err = sc.send(m)
 	if err != nil {
@@ -190,15 +706,104 @@ func (sc *serverConn) sendRecvStats(m *msg) (stats McStats, err error) {
 		}
 		stats[m.key] = m.val
 	}
-	return
+}
+
+// sendRecvMulti sends a batch of requests followed by a NOOP and receives
+// responses until the NOOP response arrives. Responses are matched to their
+// request through the opaque field, so quiet requests that don't produce a
+// response are left untouched. A request received a response if its magic
+// code is magicRecv afterwards, its status is left in ResvOrStatus.
+func (sc *serverConn) sendRecvMulti(ms []*msg) error {
+	noop := &msg{
+		header: header{
+			Op: opNoop,
+		},
+	}
+
+	sc.buf.Reset()
+	pending := make(map[uint32]*msg, len(ms)+1)
+	for _, m := range ms {
+		err := sc.encode(m)
+		if err != nil {
+			return err
+		}
+		pending[m.Opaque] = m
+	}
+	err := sc.encode(noop)
+	if err != nil {
+		return err
+	}
+	pending[noop.Opaque] = noop
+
+	ctx := context.Background()
+	err = sc.flush(ctx)
+	if err != nil {
+		sc.resetConn(err)
+		return err
+	}
+
+	for {
+		var h header
+		err = sc.recvHeader(ctx, &h)
+		if err != nil {
+			sc.resetConn(err)
+			return err
+		}
+
+		m, ok := pending[h.Opaque]
+		if !ok {
+			err = ErrMalformedResponse
+			sc.resetConn(err)
+			return err
+		}
+		m.header = h
+
+		err = sc.recvBody(m)
+		if err != nil && (err.(*Error).Status == StatusNetworkError || sc.conn == nil) {
+			// only got half a response, or refused a huge one
+			m.Magic = 0
+			sc.resetConn(err)
+			return err
+		}
+		if m == noop {
+			return nil
+		}
+	}
 }
 
 // send sends a request to the memcache server.
 func (sc *serverConn) send(m *msg) error {
+	// drop anything left over from a previously failed send
+	sc.buf.Reset()
+	err := sc.encode(m)
+	if err != nil {
+		return err
+	}
+	return sc.flush(m.context())
+}
+
+// encode writes a request into the send buffer without sending it.
+func (sc *serverConn) encode(m *msg) error {
+	err := sc.encodeHead(m, len(m.val))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(sc.buf, m.val)
+	if err != nil {
+		return wrapError(StatusNetworkError, err)
+	}
+
+	return nil
+}
+
+// encodeHead writes everything of a request up to its value, which is vlen
+// bytes long, into the send buffer.
+func (sc *serverConn) encodeHead(m *msg, vlen int) error {
 	m.Magic = magicSend
 	m.ExtraLen = sizeOfExtras(m.iextras)
 	m.KeyLen = uint16(len(m.key))
-	m.BodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen) + uint32(len(m.val))
+	m.BodyLen = uint32(m.ExtraLen) + uint32(m.KeyLen) + uint32(vlen)
 	m.Opaque = sc.opq
 	sc.opq++
 
@@ -220,14 +825,17 @@ func (sc *serverConn) send(m *msg) error {
 		return wrapError(StatusNetworkError, err)
 	}
 
-	_, err = io.WriteString(sc.buf, m.val)
-	if err != nil {
-		return wrapError(StatusNetworkError, err)
-	}
+	return nil
+}
 
+// flush writes all buffered requests to the memcache server.
+func (sc *serverConn) flush(ctx context.Context) error {
 	// Make sure write does not block forever
-	sc.conn.SetWriteDeadline(time.Now().Add(sc.config.ConnectionTimeout))
-	_, err = sc.buf.WriteTo(sc.conn)
+	sc.setDeadline(ctx, sc.conn.SetWriteDeadline, sc.writeTimeout())
+	sc.lastUsed = time.Now()
+	sc.debug("sent", sc.buf.Bytes())
+	n, err := sc.buf.WriteTo(sc.conn)
+	atomic.AddUint64(&sc.sent, uint64(n))
 	if err != nil {
 		return wrapError(StatusNetworkError, err)
 	}
@@ -238,23 +846,102 @@ func (sc *serverConn) send(m *msg) error {
 // recv receives a memcached response. It takes a msg into which to store the
 // response.
 func (sc *serverConn) recv(m *msg) error {
+	opaque := m.Opaque
+	err := sc.recvHeader(m.context(), &m.header)
+	if err != nil {
+		return err
+	}
+	if m.Opaque != opaque {
+		// not the response to our request, we are out of sync with the server
+		return ErrMalformedResponse
+	}
+	return sc.recvBody(m)
+}
+
+// recvHeader receives the header of a memcached response.
+func (sc *serverConn) recvHeader(ctx context.Context, h *header) error {
 	// Make sure read does not block forever
-	sc.conn.SetReadDeadline(time.Now().Add(sc.config.ConnectionTimeout))
+	sc.setDeadline(ctx, sc.conn.SetReadDeadline, sc.readTimeout())
 
-	err := binary.Read(sc.conn, binary.BigEndian, &m.header)
+	// wait for the response without consuming any of it, so that giving up
+	// here leaves the stream in sync
+	if _, err := sc.rbuf.Peek(1); err != nil {
+		return wrapError(StatusNetworkError, err)
+	}
+	sc.midResponse = true
+	err := binary.Read(sc.rbuf, binary.BigEndian, h)
 	if err != nil {
 		return wrapError(StatusNetworkError, err)
 	}
+	atomic.AddUint64(&sc.recvd, uint64(binary.Size(h)))
+	if sc.config.DebugWriter != nil {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, h)
+		sc.debug("received header", b.Bytes())
+	}
 
-	bd := make([]byte, m.BodyLen)
-	_, err = io.ReadFull(sc.conn, bd)
+	// a body too short for its extras and key can't be split up, and the
+	// stream can't be trusted anymore either
+	if uint32(h.ExtraLen)+uint32(h.KeyLen) > h.BodyLen {
+		return ErrMalformedResponse
+	}
+	return nil
+}
+
+// maxReusedBody is the largest response body read into the reused buffer.
+const maxReusedBody = 64 * 1024
+
+// recvBody receives the body of a memcached response whose header has already
+// been stored in m.
+func (sc *serverConn) recvBody(m *msg) error {
+	// a discarded value is skipped without buffering it, and one read into
+	// m.dst goes there directly
+	size := m.BodyLen
+	hlen := uint32(m.ExtraLen) + uint32(m.KeyLen)
+	intoDst := m.dst != nil && m.ResvOrStatus == StatusOK
+	if (m.discardVal || intoDst) && size > hlen {
+		size = hlen
+	}
+	// refuse to buffer huge bodies, the one we're not reading leaves the
+	// stream out of sync though
+	if max := sc.config.MaxResponseSize; max > 0 && size > uint32(max) {
+		sc.close()
+		return ErrValueTooLarge
+	}
+
+	// key and value are copied out into strings, so the buffer can be reused.
+	// Large bodies get their own buffer to not pin their memory.
+	var bd []byte
+	if size > maxReusedBody {
+		bd = make([]byte, size)
+	} else {
+		if cap(sc.body) < int(size) {
+			sc.body = make([]byte, size)
+		}
+		bd = sc.body[:size]
+	}
+	_, err := io.ReadFull(sc.rbuf, bd)
+	if rest := m.BodyLen - size; err == nil && rest > 0 {
+		if intoDst && int(rest) <= len(m.dst) {
+			_, err = io.ReadFull(sc.rbuf, m.dst[:rest])
+		} else {
+			_, err = io.CopyN(ioutil.Discard, sc.rbuf, int64(rest))
+		}
+	}
 	if err != nil {
 		return wrapError(StatusNetworkError, err)
 	}
+	sc.midResponse = false
+	atomic.AddUint64(&sc.recvd, uint64(m.BodyLen))
+	sc.debug("received body", bd)
 
-	buf := bytes.NewBuffer(bd)
+	buf := bytes.NewBuffer(bd[:m.ExtraLen])
 
-	if m.ResvOrStatus == 0 && m.ExtraLen > 0 {
+	// error responses usually come without extras, only decode on success
+	if m.ResvOrStatus == 0 && len(m.oextras) > 0 {
+		if int(m.ExtraLen) < sizeOfOutExtras(m.oextras) {
+			return ErrMalformedResponse
+		}
 		for _, e := range m.oextras {
 			err := binary.Read(buf, binary.BigEndian, e)
 			if err != nil {
@@ -262,13 +949,28 @@ func (sc *serverConn) recv(m *msg) error {
 			}
 		}
 	}
+	if m.rextras != nil {
+		m.rextras = append(m.rextras[:0], bd[:m.ExtraLen]...)
+	}
 
+	// skip any extras we weren't asked for
+	buf = bytes.NewBuffer(bd[m.ExtraLen:])
 	m.key = string(buf.Next(int(m.KeyLen)))
 	vlen := int(m.BodyLen) - int(m.ExtraLen) - int(m.KeyLen)
-	m.val = string(buf.Next(int(vlen)))
+	if !intoDst {
+		m.val = string(buf.Next(int(vlen)))
+	}
 	return newError(m.ResvOrStatus)
 }
 
+// sizeOfOutExtras returns the size of the extras expected in a response.
+func sizeOfOutExtras(extras []interface{}) (l int) {
+	for _, e := range extras {
+		l += binary.Size(e)
+	}
+	return
+}
+
 // sizeOfExtras returns the size of the extras field for the memcache request.
 func sizeOfExtras(extras []interface{}) (l uint8) {
 	for _, e := range extras {
@@ -288,15 +990,24 @@ func sizeOfExtras(extras []interface{}) (l uint8) {
 	return
 }
 
-// resetConn destroy connection if a network error occurred. serverConn will
-// reconnect on next usage.
-func (sc *serverConn) resetConn(err error) {
-	if err.(*Error).Status == StatusNetworkError {
+// close closes the connection, unless that happened already.
+func (sc *serverConn) close() {
+	if sc.conn != nil {
 		sc.conn.Close()
 		sc.conn = nil
 	}
 }
 
+// resetConn destroy connection if a network error occurred, e.g. the server
+// closed it part way through a response, or the responses can no longer be
+// matched to requests. serverConn will reconnect on next usage.
+func (sc *serverConn) resetConn(err error) {
+	switch err.(*Error).Status {
+	case StatusNetworkError, StatusMalformedResponse:
+		sc.close()
+	}
+}
+
 func (sc *serverConn) backup(m *msg) {
 	backupMsg(m, &sc.backupMsg)
 }
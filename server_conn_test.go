@@ -0,0 +1,1160 @@
+package mc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn is an in-memory net.Conn. Everything written to it is recorded in
+// w, reads are served from r. If failAfter is non-negative, writes fail once
+// that many bytes have been written.
+type testConn struct {
+	r         bytes.Buffer
+	w         bytes.Buffer
+	failAfter int
+	closed    bool
+}
+
+func newTestConn() *testConn {
+	return &testConn{failAfter: -1}
+}
+
+func (c *testConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	if c.failAfter >= 0 {
+		n := c.failAfter - c.w.Len()
+		if n < len(b) {
+			if n > 0 {
+				c.w.Write(b[:n])
+			} else {
+				n = 0
+			}
+			return n, errors.New("test write failure")
+		}
+	}
+	return c.w.Write(b)
+}
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *testConn) LocalAddr() net.Addr                { return nil }
+func (c *testConn) RemoteAddr() net.Addr               { return nil }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// addResponse queues a response on the read side of the connection.
+func (c *testConn) addResponse(op opCode, status uint16, opaque uint32, extras []byte, key, val string) {
+	h := header{
+		Magic:        magicRecv,
+		Op:           op,
+		KeyLen:       uint16(len(key)),
+		ExtraLen:     uint8(len(extras)),
+		ResvOrStatus: status,
+		BodyLen:      uint32(len(extras) + len(key) + len(val)),
+		Opaque:       opaque,
+	}
+	binary.Write(&c.r, binary.BigEndian, h)
+	c.r.Write(extras)
+	c.r.WriteString(key)
+	c.r.WriteString(val)
+}
+
+// nextRequest parses the next request written to the connection.
+func (c *testConn) nextRequest(t *testing.T) (h header, extras []byte, key, val string) {
+	err := binary.Read(&c.w, binary.BigEndian, &h)
+	assertEqualf(t, nil, err, "no request: %v", err)
+	extras = c.w.Next(int(h.ExtraLen))
+	key = string(c.w.Next(int(h.KeyLen)))
+	val = string(c.w.Next(int(h.BodyLen) - int(h.ExtraLen) - int(h.KeyLen)))
+	return
+}
+
+// replay answers each request read from c with the next response queued on
+// tc, until there are no responses left.
+func (tc *testConn) replay(c io.ReadWriter) {
+	for tc.r.Len() > 0 {
+		var h header
+		if binary.Read(c, binary.BigEndian, &h) != nil {
+			return
+		}
+		io.CopyN(ioutil.Discard, c, int64(h.BodyLen))
+		var rh header
+		binary.Read(&tc.r, binary.BigEndian, &rh)
+		binary.Write(c, binary.BigEndian, rh)
+		c.Write(tc.r.Next(int(rh.BodyLen)))
+	}
+}
+
+// newTestServerConn creates a serverConn that is already connected over tc.
+func newTestServerConn(tc *testConn) *serverConn {
+	sc := newServerConn("test", "tcp", "", "", DefaultConfig()).(*serverConn)
+	sc.setConn(tc)
+	return sc
+}
+
+// Test that a failed write doesn't leave stale bytes in the send buffer.
+func TestSendShortWrite(t *testing.T) {
+	tc := newTestConn()
+	tc.failAfter = 10
+	sc := newTestServerConn(tc)
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		key: "foo",
+	}
+	err := sc.send(m)
+	assertNotEqualf(t, nil, err, "expected an error from a short write")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status,
+		"expected a network error: %v", err)
+
+	tc2 := newTestConn()
+	sc.setConn(tc2)
+	m = &msg{
+		header: header{
+			Op: opGet,
+		},
+		key: "bar",
+	}
+	err = sc.send(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, 24+len("bar"), tc2.w.Len(),
+		"wrong request size, stale bytes in buffer? %v", tc2.w.Bytes())
+	assertEqualf(t, "bar", string(tc2.w.Bytes()[24:]), "wrong key sent")
+}
+
+// Test that a failed write returns straight away without waiting for a
+// response, and drops the connection.
+func TestSendRecvWriteError(t *testing.T) {
+	tc := newTestConn()
+	tc.failAfter = 5
+	tc.r.WriteString("response that should never be read")
+	sc := newTestServerConn(tc)
+
+	m := &msg{
+		header: header{
+			Op: opNoop,
+		},
+	}
+	err := sc.sendRecv(m)
+	assertNotEqualf(t, nil, err, "expected an error from a failed write")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status,
+		"expected a network error: %v", err)
+	assertEqualf(t, len("response that should never be read"), tc.r.Len(),
+		"read a response after a failed write")
+	assertTruef(t, tc.closed, "connection should have been closed")
+	assertTruef(t, sc.conn == nil, "connection should have been reset")
+}
+
+// Test that an unknown status from the server keeps its code.
+func TestRecvUnknownStatus(t *testing.T) {
+	tc := newTestConn()
+	tc.addResponse(opGet, 0x99, 0, nil, "", "weird")
+	sc := newTestServerConn(tc)
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		key: "foo",
+	}
+	err := sc.sendRecv(m)
+	assertNotEqualf(t, nil, err, "expected an error for an unknown status")
+	assertEqualf(t, uint16(0x99), err.(*Error).Status, "wrong status: %v", err)
+	assertEqualf(t, "mc: unknown status 153 from server", err.Error(),
+		"wrong error message")
+
+	// the unknown error status still maps to its sentinel
+	tc.addResponse(opGet, StatusUnknownError, 1, nil, "", "unknown")
+	err = sc.sendRecv(m)
+	assertEqualf(t, ErrUnknownError, err, "expected unknown error: %v", err)
+}
+
+// Test that the extras of a response are only decoded if they are there.
+func TestRecvExtras(t *testing.T) {
+	tests := []struct {
+		status uint16
+		extras []byte
+		err    error
+	}{
+		// error without a body, flags must be left alone
+		{StatusNotFound, nil, ErrNotFound},
+		{StatusOK, []byte{0, 0, 0, 7}, nil},
+		// more than expected is fine, the rest is skipped
+		{StatusOK, []byte{0, 0, 0, 7, 0, 0, 0, 9}, nil},
+		// less than expected isn't
+		{StatusOK, []byte{0, 7}, ErrMalformedResponse},
+	}
+
+	for _, tt := range tests {
+		tc := newTestConn()
+		tc.addResponse(opGet, tt.status, 0, tt.extras, "", "bar")
+		sc := newTestServerConn(tc)
+
+		flags := uint32(42)
+		m := &msg{
+			header: header{
+				Op: opGet,
+			},
+			oextras: []interface{}{&flags},
+			key:     "foo",
+		}
+		err := sc.sendRecv(m)
+		assertEqualf(t, tt.err, err, "wrong error for extras %v: %v", tt.extras, err)
+		if tt.err == nil {
+			assertEqualf(t, uint32(7), flags, "wrong flags for extras %v", tt.extras)
+			assertEqualf(t, "bar", m.val, "wrong value for extras %v", tt.extras)
+		} else if tt.status != StatusOK {
+			assertEqualf(t, uint32(42), flags, "flags decoded from an error response")
+		}
+	}
+}
+
+// Test that a response to some other request is rejected and drops the
+// connection, as later responses can't be trusted either.
+func TestRecvOpaqueMismatch(t *testing.T) {
+	tc := newTestConn()
+	tc.addResponse(opGet, StatusOK, 5, []byte{0, 0, 0, 0}, "", "stale")
+	sc := newTestServerConn(tc)
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{new(uint32)},
+		key:     "foo",
+	}
+	err := sc.sendRecv(m)
+	assertEqualf(t, ErrMalformedResponse, err, "expected a malformed response: %v", err)
+	assertTruef(t, tc.closed, "connection should have been closed")
+	assertTruef(t, sc.conn == nil, "connection should have been reset")
+}
+
+// abortedConn is a net.Conn that holds back setting a write deadline until
+// the deadline set by watchContext to abort the request was set.
+type abortedConn struct {
+	net.Conn
+	aborted chan struct{}
+}
+
+func (c *abortedConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetDeadline(t)
+	close(c.aborted)
+	return err
+}
+
+func (c *abortedConn) SetWriteDeadline(t time.Time) error {
+	<-c.aborted
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Test that a context done before the request is sent still aborts it, rather
+// than the deadlines for sending and receiving replacing the one that aborts.
+func TestSendRecvContextBeforeSend(t *testing.T) {
+	conn, srv := net.Pipe()
+	defer srv.Close()
+	// swallow the request but never respond
+	go io.Copy(ioutil.Discard, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sc := newServerConn("test", "tcp", "", "", DefaultConfig()).(*serverConn)
+	sc.setConn(&abortedConn{conn, make(chan struct{})})
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		key: "foo",
+		ctx: ctx,
+	}
+
+	start := time.Now()
+	err := sc.sendRecv(m)
+	assertNotEqualf(t, nil, err, "expected an error")
+	mErr := err.(*Error)
+	assertEqualf(t, StatusContextError, mErr.Status, "wrong status: %v", err)
+	assertEqualf(t, context.Canceled, mErr.WrappedError, "wrong wrapped error: %v", err)
+	assertTruef(t, time.Since(start) < time.Second,
+		"request wasn't aborted in time: %v", time.Since(start))
+}
+
+// Test that a request blocked on a server that never responds is aborted once
+// its context is done.
+func TestSendRecvContext(t *testing.T) {
+	// contexts are made per test, so each one is done while waiting for the
+	// response rather than before the request is sent
+	tests := []struct {
+		ctx func() (context.Context, context.CancelFunc)
+		err error
+	}{
+		{func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := tt.ctx()
+		conn, srv := net.Pipe()
+		// swallow the request but never respond
+		go io.Copy(ioutil.Discard, srv)
+
+		sc := newServerConn("test", "tcp", "", "", DefaultConfig()).(*serverConn)
+		sc.setConn(conn)
+		m := &msg{
+			header: header{
+				Op: opGet,
+			},
+			key: "foo",
+			ctx: ctx,
+		}
+
+		start := time.Now()
+		err := sc.sendRecv(m)
+		assertNotEqualf(t, nil, err, "expected an error")
+		mErr := err.(*Error)
+		assertEqualf(t, StatusContextError, mErr.Status, "wrong status: %v", err)
+		assertEqualf(t, tt.err, mErr.WrappedError, "wrong wrapped error: %v", err)
+		assertTruef(t, time.Since(start) < time.Second,
+			"request wasn't aborted in time: %v", time.Since(start))
+		assertTruef(t, sc.conn != nil && sc.resync,
+			"connection should be kept and resynced before reuse")
+		srv.Close()
+		cancel()
+	}
+}
+
+// Test SASL authentication using CRAM-MD5.
+func TestAuthCRAMMD5(t *testing.T) {
+	const Challenge = "<1896.697170952@postoffice.reston.mci.net>"
+
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusOK, 0, nil, "", "CRAM-MD5 PLAIN")
+	tc.addResponse(opAuthStart, StatusAuthContinue, 1, nil, "", Challenge)
+	tc.addResponse(opAuthStep, StatusOK, 2, nil, "", "Authenticated")
+	sc := newTestServerConn(tc)
+	sc.username = "tim"
+	sc.password = "tanstaaftanstaaf"
+
+	err := sc.auth(context.Background())
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	h, _, _, _ := tc.nextRequest(t)
+	assertEqualf(t, opAuthList, h.Op, "expected auth list request")
+	h, _, key, val := tc.nextRequest(t)
+	assertEqualf(t, opAuthStart, h.Op, "expected auth start request")
+	assertEqualf(t, "CRAM-MD5", key, "wrong mechanism")
+	assertEqualf(t, "", val, "unexpected auth start data")
+	h, _, key, val = tc.nextRequest(t)
+	assertEqualf(t, opAuthStep, h.Op, "expected auth step request")
+	assertEqualf(t, "CRAM-MD5", key, "wrong mechanism")
+	// example from RFC 2195
+	assertEqualf(t, "tim b913a602c7eda7a495b4e6e7334d3890", val, "wrong response")
+}
+
+// Test that bad credentials give ErrAuthFailed.
+func TestAuthFailed(t *testing.T) {
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusOK, 0, nil, "", "PLAIN")
+	tc.addResponse(opAuthStart, StatusAuthRequired, 1, nil, "", "Auth failure")
+	sc := newTestServerConn(tc)
+	sc.username = "user"
+	sc.password = "wrong"
+
+	err := sc.auth(context.Background())
+	assertEqualf(t, ErrAuthFailed, err, "expected auth failure: %v", err)
+
+	// auth continue makes no sense for PLAIN
+	tc = newTestConn()
+	tc.addResponse(opAuthList, StatusOK, 0, nil, "", "PLAIN")
+	tc.addResponse(opAuthStart, StatusAuthContinue, 1, nil, "", "")
+	sc = newTestServerConn(tc)
+
+	err = sc.auth(context.Background())
+	assertEqualf(t, ErrAuthContinue, err, "expected auth continue: %v", err)
+}
+
+// Test that connections are opened with Config.DialContext if it is set.
+func TestDialContext(t *testing.T) {
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+	tc.addResponse(opGet, StatusOK, 1, []byte{0, 0, 0, 0}, "", "bar")
+
+	config := DefaultConfig()
+	var network, address string
+	config.DialContext = func(ctx context.Context, n, a string) (net.Conn, error) {
+		network, address = n, a
+		return tc, nil
+	}
+	sc := newServerConn("test", "unix", "user", "pass", config).(*serverConn)
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{new(uint32)},
+		key:     "foo",
+	}
+	err := sc.perform(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "unix", network, "wrong network dialed")
+	assertEqualf(t, "test", address, "wrong address dialed")
+	assertEqualf(t, "bar", m.val, "wrong value")
+}
+
+// testCertificate returns a self-signed certificate for "localhost".
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertEqualf(t, nil, err, "cannot generate key: %v", err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assertEqualf(t, nil, err, "cannot create certificate: %v", err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Test that requests go over TLS when Config.TLSConfig is set.
+func TestTLS(t *testing.T) {
+	cert := testCertificate(t)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	conn, srv := net.Pipe()
+	defer srv.Close()
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+	tc.addResponse(opGet, StatusOK, 1, []byte{0, 0, 0, 0}, "", "bar")
+	go tc.replay(tls.Server(srv, &tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	config := DefaultConfig()
+	config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return conn, nil
+	}
+	config.TLSConfig = &tls.Config{RootCAs: roots}
+	sc := newServerConn("localhost:11211", "tcp", "", "", config).(*serverConn)
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{new(uint32)},
+		key:     "foo",
+	}
+	err := sc.perform(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", m.val, "wrong value")
+	_, ok := sc.conn.(*tls.Conn)
+	assertTruef(t, ok, "connection isn't a TLS connection")
+}
+
+// Test that a failed TLS handshake is reported as a network error.
+func TestTLSHandshakeError(t *testing.T) {
+	// a pipe would deadlock with both ends writing, so use a real socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assertEqualf(t, nil, err, "cannot listen: %v", err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// certificate isn't trusted by the client
+		tls.Server(c, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}).Handshake()
+		c.Close()
+	}()
+
+	config := DefaultConfig()
+	config.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	sc := newServerConn(l.Addr().String(), "tcp", "", "", config).(*serverConn)
+
+	start := time.Now()
+	err = sc.perform(&msg{header: header{Op: opNoop}})
+	assertNotEqualf(t, nil, err, "expected a handshake error")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status,
+		"expected a network error: %v", err)
+	assertTruef(t, time.Since(start) < time.Second,
+		"handshake error took too long: %v", time.Since(start))
+	assertTruef(t, sc.conn == nil, "connection shouldn't be set")
+}
+
+// Test that a CAS that doesn't fit in 32 bits comes back intact.
+func TestIncrHighCAS(t *testing.T) {
+	const CAS = uint64(0xfedcba9876543210)
+
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+	binary.Write(&tc.r, binary.BigEndian, header{
+		Magic:   magicRecv,
+		Op:      opIncrement,
+		BodyLen: 8,
+		Opaque:  1,
+		CAS:     CAS,
+	})
+	binary.Write(&tc.r, binary.BigEndian, uint64(42))
+
+	config := DefaultConfig()
+	config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return tc, nil
+	}
+	c := NewMCwithConfig("test", "", "", config)
+
+	n, cas, err := c.Incr("foo", 1, 0, 0, 0)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, uint64(42), n, "wrong value")
+	assertEqualf(t, CAS, cas, "CAS was truncated")
+}
+
+// Test a round trip over a unix domain socket.
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mc")
+	assertEqualf(t, nil, err, "cannot create temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "memcached.sock")
+	l, err := net.Listen("unix", path)
+	assertEqualf(t, nil, err, "cannot listen: %v", err)
+	defer l.Close()
+
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+	tc.addResponse(opGet, StatusOK, 1, []byte{0, 0, 0, 0}, "", "bar")
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		tc.replay(c)
+		c.Close()
+	}()
+
+	c := NewMC("unix://"+path, "", "")
+	v, _, _, err := c.Get("foo")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", v, "wrong value")
+}
+
+// Test that the data type of values is sent and returned.
+func TestDataType(t *testing.T) {
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+	tc.addResponse(opSet, StatusOK, 1, nil, "", "")
+	binary.Write(&tc.r, binary.BigEndian, header{
+		Magic:    magicRecv,
+		Op:       opGet,
+		ExtraLen: 4,
+		DataType: DataTypeJSON,
+		BodyLen:  4 + 2,
+		Opaque:   2,
+	})
+	tc.r.Write([]byte{0, 0, 0, 0})
+	tc.r.WriteString("{}")
+
+	config := DefaultConfig()
+	config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return tc, nil
+	}
+	c := NewMCwithConfig("test", "", "", config)
+
+	_, err := c.SetWithDataType("foo", "{}", 0, 0, 0, DataTypeJSON)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	v, _, _, dt, err := c.GetWithDataType("foo")
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "{}", v, "wrong value")
+	assertEqualf(t, DataTypeJSON, dt, "wrong data type received")
+
+	tc.nextRequest(t)
+	h, _, _, _ := tc.nextRequest(t)
+	assertEqualf(t, opSet, h.Op, "expected set request")
+	assertEqualf(t, DataTypeJSON, h.DataType, "wrong data type sent")
+	h, _, _, _ = tc.nextRequest(t)
+	assertEqualf(t, DataTypeRaw, h.DataType, "get shouldn't send a data type")
+}
+
+// Test that ReadTimeout overrides ConnectionTimeout for reading responses.
+func TestReadTimeout(t *testing.T) {
+	conn, srv := net.Pipe()
+	defer srv.Close()
+	// swallow the request but never respond
+	go io.Copy(ioutil.Discard, srv)
+
+	config := DefaultConfig()
+	config.ConnectionTimeout = 10 * time.Second
+	config.ReadTimeout = 50 * time.Millisecond
+	sc := newServerConn("test", "tcp", "", "", config).(*serverConn)
+	sc.setConn(conn)
+
+	start := time.Now()
+	err := sc.sendRecv(&msg{header: header{Op: opNoop}})
+	assertNotEqualf(t, nil, err, "expected a timeout")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status,
+		"expected a network error: %v", err)
+	assertTruef(t, time.Since(start) < time.Second,
+		"read didn't time out in time: %v", time.Since(start))
+}
+
+// Test the errors Add and Replace return for each status from the server.
+func TestAddReplaceStatus(t *testing.T) {
+	tests := []struct {
+		op     opCode
+		status uint16
+		err    error
+	}{
+		{opAdd, StatusOK, nil},
+		{opAdd, StatusKeyExists, ErrKeyExists},
+		{opAdd, StatusValueTooLarge, ErrValueTooLarge},
+		{opAdd, StatusValueNotStored, ErrValueNotStored},
+		{opReplace, StatusOK, nil},
+		{opReplace, StatusNotFound, ErrNotFound},
+		{opReplace, StatusKeyExists, ErrKeyExists},
+		{opReplace, StatusValueNotStored, ErrValueNotStored},
+	}
+
+	for _, tt := range tests {
+		tc := newTestConn()
+		tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+		tc.addResponse(tt.op, tt.status, 1, nil, "", "")
+		config := DefaultConfig()
+		config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return tc, nil
+		}
+		c := NewMCwithConfig("test", "", "", config)
+
+		var err error
+		if tt.op == opAdd {
+			_, err = c.Add("foo", "bar", 0, 0)
+		} else {
+			_, err = c.Replace("foo", "bar", 0, 0, 0)
+		}
+		assertEqualf(t, tt.err, err, "wrong error for op %#x, status %#x: %v",
+			tt.op, tt.status, err)
+
+		tc.nextRequest(t)
+		h, _, _, _ := tc.nextRequest(t)
+		assertEqualf(t, tt.op, h.Op, "wrong op sent")
+	}
+}
+
+// Test that Connect opens and authenticates all pooled connections.
+func TestConnect(t *testing.T) {
+	for _, status := range []uint16{StatusOK, StatusAuthRequired} {
+		var conns []*testConn
+		config := DefaultConfig()
+		config.PoolSize = 3
+		config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			tc := newTestConn()
+			tc.addResponse(opAuthList, StatusOK, 0, nil, "", "PLAIN")
+			tc.addResponse(opAuthStart, status, 1, nil, "", "")
+			conns = append(conns, tc)
+			return tc, nil
+		}
+		c := NewMCwithConfig("test", "user", "pass", config)
+
+		err := c.Connect()
+		if status == StatusOK {
+			assertEqualf(t, nil, err, "unexpected error: %v", err)
+			assertEqualf(t, 3, len(conns), "not all connections opened")
+			for _, tc := range conns {
+				assertEqualf(t, 0, tc.r.Len(), "connection not authenticated")
+			}
+			// already connected
+			err = c.Connect()
+			assertEqualf(t, nil, err, "unexpected error: %v", err)
+			assertEqualf(t, 3, len(conns), "connections opened twice")
+		} else {
+			assertEqualf(t, ErrAuthFailed, err, "expected auth failure: %v", err)
+			assertTruef(t, conns[0].closed, "connection should have been closed")
+		}
+	}
+}
+
+// Test detecting connections closed by the server while idle.
+func TestAlive(t *testing.T) {
+	conn, srv := net.Pipe()
+	sc := newServerConn("test", "tcp", "", "", DefaultConfig()).(*serverConn)
+	sc.setConn(conn)
+	assertTruef(t, sc.alive(), "open connection reported dead")
+	// doesn't affect later requests
+	go func() {
+		tc := newTestConn()
+		tc.addResponse(opNoop, StatusOK, 0, nil, "", "")
+		tc.replay(srv)
+	}()
+	err := sc.sendRecv(&msg{header: header{Op: opNoop}})
+	assertEqualf(t, nil, err, "unexpected error after liveness check: %v", err)
+
+	// unexpected data from the server
+	go srv.Write([]byte{0x81})
+	time.Sleep(10 * time.Millisecond)
+	assertTruef(t, !sc.alive(), "connection with stray data reported alive")
+
+	conn, srv = net.Pipe()
+	sc.setConn(conn)
+	srv.Close()
+	assertTruef(t, !sc.alive(), "closed connection reported alive")
+
+	// replaced once idle
+	sc.lastUsed = time.Now().Add(-2 * idleCheck)
+	var dialed bool
+	sc.config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = true
+		tc := newTestConn()
+		tc.addResponse(opAuthList, StatusUnknownCommand, sc.opq, nil, "", "Unknown command")
+		return tc, nil
+	}
+	err = sc.open(context.Background())
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertTruef(t, dialed, "closed connection wasn't replaced")
+}
+
+// Test that mechanisms are matched by name, not substring, and that the
+// strongest one is used.
+func TestAuthMechanisms(t *testing.T) {
+	tests := []struct {
+		list string
+		op   opCode
+		mech string
+	}{
+		{"PLAIN CRAM-MD5", opAuthStart, "CRAM-MD5"},
+		{"PLAIN", opAuthStart, "PLAIN"},
+		{"SCRAM-SHA-1 PLAIN", opAuthStart, "PLAIN"},
+		{"XPLAIN CRAM-MD5X", opAuthList, ""},
+	}
+
+	for _, tt := range tests {
+		tc := newTestConn()
+		tc.addResponse(opAuthList, StatusOK, 0, nil, "", tt.list)
+		tc.addResponse(opAuthStart, StatusAuthRequired, 1, nil, "", "Auth failure")
+		sc := newTestServerConn(tc)
+
+		err := sc.auth(context.Background())
+		tc.nextRequest(t)
+		if tt.mech == "" {
+			assertEqualf(t, StatusAuthUnknown, err.(*Error).Status,
+				"expected unknown mechanisms for %q: %v", tt.list, err)
+			assertEqualf(t, 0, tc.w.Len(), "auth started for %q", tt.list)
+			continue
+		}
+		h, _, key, _ := tc.nextRequest(t)
+		assertEqualf(t, tt.op, h.Op, "wrong request for %q", tt.list)
+		assertEqualf(t, tt.mech, key, "wrong mechanism for %q", tt.list)
+	}
+}
+
+// Test listing the mechanisms of each server.
+func TestClientAuthMechanisms(t *testing.T) {
+	tc := newTestConn()
+	tc.addResponse(opAuthList, StatusUnknownCommand, 0, nil, "", "Unknown command")
+	tc.addResponse(opAuthList, StatusOK, 1, nil, "", "CRAM-MD5 PLAIN")
+	config := DefaultConfig()
+	config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return tc, nil
+	}
+	c := NewMCwithConfig("test", "", "", config)
+
+	mechs, err := c.AuthMechanisms()
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, map[string][]string{"test:11211": {"CRAM-MD5", "PLAIN"}}, mechs,
+		"wrong mechanisms")
+}
+
+// Test that pipelined responses are matched to their requests by opaque, not
+// by the order they arrive in.
+func TestSendRecvMultiOrder(t *testing.T) {
+	tc := newTestConn()
+	sc := newTestServerConn(tc)
+	first := sc.opq
+	tc.addResponse(opGetQ, StatusOK, first+2, []byte{0, 0, 0, 3}, "", "three")
+	tc.addResponse(opGetQ, StatusOK, first, []byte{0, 0, 0, 1}, "", "one")
+	tc.addResponse(opNoop, StatusOK, first+3, nil, "", "")
+
+	ms := make([]*msg, 3)
+	flags := make([]uint32, 3)
+	for i := range ms {
+		ms[i] = &msg{
+			header: header{
+				Op: opGetQ,
+			},
+			oextras: []interface{}{&flags[i]},
+			key:     "foo",
+		}
+	}
+	err := sc.sendRecvMulti(ms)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+
+	assertEqualf(t, "one", ms[0].val, "wrong value for first request")
+	assertEqualf(t, uint32(1), flags[0], "wrong flags for first request")
+	assertNotEqualf(t, magicRecv, ms[1].Magic, "quiet miss shouldn't have a response")
+	assertEqualf(t, "three", ms[2].val, "wrong value for third request")
+	assertEqualf(t, uint32(3), flags[2], "wrong flags for third request")
+}
+
+// Test that a discarded value is skipped without losing track of the stream.
+func TestRecvDiscardVal(t *testing.T) {
+	tc := newTestConn()
+	sc := newTestServerConn(tc)
+	tc.addResponse(opGet, StatusOK, sc.opq, []byte{0, 0, 0, 0}, "", strings.Repeat("x", 2*maxReusedBody))
+	tc.addResponse(opGet, StatusOK, sc.opq+1, []byte{0, 0, 0, 0}, "", "bar")
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		key:        "foo",
+		discardVal: true,
+	}
+	err := sc.sendRecv(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "", m.val, "value should have been discarded")
+
+	m = &msg{
+		header: header{
+			Op: opGet,
+		},
+		key: "foo",
+	}
+	err = sc.sendRecv(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "bar", m.val, "wrong value after a discarded one")
+}
+
+// Test that a header whose lengths don't add up is rejected instead of
+// panicking, for single and pipelined requests.
+func TestRecvInconsistentLengths(t *testing.T) {
+	for _, multi := range []bool{false, true} {
+		tc := newTestConn()
+		sc := newTestServerConn(tc)
+		h := header{
+			Magic:    magicRecv,
+			Op:       opGet,
+			KeyLen:   3,
+			ExtraLen: 4,
+			BodyLen:  5,
+			Opaque:   sc.opq,
+		}
+		binary.Write(&tc.r, binary.BigEndian, h)
+		tc.r.WriteString("12345")
+
+		m := &msg{
+			header: header{
+				Op: opGet,
+			},
+			oextras: []interface{}{new(uint32)},
+			key:     "foo",
+		}
+		var err error
+		if multi {
+			err = sc.sendRecvMulti([]*msg{m})
+		} else {
+			err = sc.sendRecv(m)
+		}
+		assertEqualf(t, ErrMalformedResponse, err, "expected a malformed response: %v", err)
+		assertTruef(t, tc.closed, "connection should have been closed")
+	}
+}
+
+// Test that requests and responses are dumped to the DebugWriter.
+func TestDebugWriter(t *testing.T) {
+	tc := newTestConn()
+	sc := newTestServerConn(tc)
+	var w bytes.Buffer
+	sc.config.DebugWriter = &w
+	tc.addResponse(opGet, StatusNotFound, sc.opq, nil, "", "Not found")
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		key: "foo",
+	}
+	err := sc.sendRecv(m)
+	assertEqualf(t, ErrNotFound, err, "expected not found: %v", err)
+
+	out := w.String()
+	for _, s := range []string{
+		"mc: test sent (27 bytes)\n00000000  80 00 00 03",
+		"mc: test received header (24 bytes)\n00000000  81 00 00 00 00 00 00 01",
+		"mc: test received body (9 bytes)",
+		"|Not found|",
+	} {
+		assertTruef(t, strings.Contains(out, s), "%q missing from dump:\n%s", s, out)
+	}
+}
+
+// Test that a connection whose request was aborted skips the late response
+// before it is used again.
+func TestResync(t *testing.T) {
+	// a pipe would deadlock with both ends writing, so use a real socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assertEqualf(t, nil, err, "cannot listen: %v", err)
+	defer l.Close()
+	late := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tc := newTestConn()
+		next := func() header {
+			var h header
+			binary.Read(c, binary.BigEndian, &h)
+			io.CopyN(ioutil.Discard, c, int64(h.BodyLen))
+			return h
+		}
+
+		// the aborted get is answered late
+		h := next()
+		<-late
+		tc.addResponse(opGet, StatusOK, h.Opaque, []byte{0, 0, 0, 0}, "", "stale")
+		h = next()
+		tc.addResponse(opNoop, StatusOK, h.Opaque, nil, "", "")
+		c.Write(tc.r.Next(tc.r.Len()))
+		h = next()
+		tc.addResponse(opGet, StatusOK, h.Opaque, []byte{0, 0, 0, 0}, "", "fresh")
+		c.Write(tc.r.Next(tc.r.Len()))
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assertEqualf(t, nil, err, "cannot dial: %v", err)
+	sc := newServerConn("test", "tcp", "", "", DefaultConfig()).(*serverConn)
+	sc.setConn(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{new(uint32)},
+		key:     "foo",
+		ctx:     ctx,
+	}
+	err = sc.perform(m)
+	assertEqualf(t, StatusContextError, err.(*Error).Status, "expected a context error: %v", err)
+	close(late)
+
+	m = &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{new(uint32)},
+		key:     "foo",
+	}
+	err = sc.perform(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, "fresh", m.val, "got the response of the aborted request")
+	assertTruef(t, sc.conn == conn, "connection should have been kept")
+}
+
+// Test connecting to a cluster with a server that can't be reached.
+func TestConnectAtLeast(t *testing.T) {
+	config := DefaultConfig()
+	config.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if strings.HasPrefix(address, "bad") {
+			return nil, errors.New("test dial failure")
+		}
+		tc := newTestConn()
+		tc.addResponse(opAuthList, StatusOK, 0, nil, "", "PLAIN")
+		tc.addResponse(opAuthStart, StatusOK, 1, nil, "", "")
+		return tc, nil
+	}
+
+	c := NewMCwithConfig("good1,bad,good2", "user", "pass", config)
+	err := c.ConnectAtLeast(3)
+	assertNotEqualf(t, nil, err, "expected an error with only 2 servers up")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "wrong status: %v", err)
+
+	c = NewMCwithConfig("good1,bad,good2", "user", "pass", config)
+	err = c.ConnectAtLeast(2)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	for _, s := range c.servers {
+		assertEqualf(t, !strings.HasPrefix(s.address, "bad"), !s.down(),
+			"wrong state for %s", s.address)
+	}
+}
+
+// Test that the connection timeout bounds connecting and authenticating
+// together, even though each step is faster than it.
+func TestConnectTimeoutAuth(t *testing.T) {
+	// a pipe would deadlock with both ends writing, so use a real socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assertEqualf(t, nil, err, "cannot listen: %v", err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tc := newTestConn()
+		for _, op := range []opCode{opAuthList, opAuthStart} {
+			var h header
+			if binary.Read(c, binary.BigEndian, &h) != nil {
+				return
+			}
+			io.CopyN(ioutil.Discard, c, int64(h.BodyLen))
+			time.Sleep(150 * time.Millisecond)
+			tc.addResponse(op, StatusOK, h.Opaque, nil, "", "PLAIN")
+			c.Write(tc.r.Next(tc.r.Len()))
+		}
+	}()
+
+	config := DefaultConfig()
+	config.ConnectionTimeout = 200 * time.Millisecond
+	sc := newServerConn(l.Addr().String(), "tcp", "user", "pass", config).(*serverConn)
+	err = sc.connect(context.Background())
+	assertNotEqualf(t, nil, err, "expected connecting to time out")
+	assertEqualf(t, StatusNetworkError, err.(*Error).Status, "expected a network error: %v", err)
+	assertTruef(t, sc.conn == nil, "connection should have been closed")
+}
+
+// Test that the server closing the connection part way through a response is
+// a network error and drops the connection, so the next request reconnects.
+func TestRecvTruncatedBody(t *testing.T) {
+	for _, multi := range []bool{false, true} {
+		tc := newTestConn()
+		sc := newTestServerConn(tc)
+		h := header{
+			Magic:    magicRecv,
+			Op:       opGet,
+			ExtraLen: 4,
+			BodyLen:  10,
+			Opaque:   sc.opq,
+		}
+		binary.Write(&tc.r, binary.BigEndian, h)
+		tc.r.WriteString("12345")
+
+		m := &msg{
+			header: header{
+				Op: opGet,
+			},
+			oextras: []interface{}{new(uint32)},
+			key:     "foo",
+		}
+		var err error
+		if multi {
+			err = sc.sendRecvMulti([]*msg{m})
+		} else {
+			err = sc.sendRecv(m)
+		}
+		assertNotEqualf(t, nil, err, "expected an error")
+		mErr := err.(*Error)
+		assertEqualf(t, StatusNetworkError, mErr.Status, "expected a network error: %v", err)
+		assertEqualf(t, io.ErrUnexpectedEOF, mErr.WrappedError, "wrong wrapped error: %v", err)
+		assertTruef(t, tc.closed, "connection should have been closed")
+		assertTruef(t, sc.conn == nil, "connection should have been dropped")
+	}
+}
+
+// Test that a server asking for more steps than a mechanism has fails the
+// authentication instead of looping.
+func TestAuthTooManySteps(t *testing.T) {
+	tests := []struct {
+		mechs string
+		steps int
+	}{
+		{"PLAIN", 0},
+		{"CRAM-MD5", 1},
+	}
+
+	for _, tt := range tests {
+		tc := newTestConn()
+		tc.addResponse(opAuthList, StatusOK, 0, nil, "", tt.mechs)
+		for i := 0; i <= tt.steps; i++ {
+			tc.addResponse(opAuthStart, StatusAuthContinue, uint32(i+1), nil, "", "challenge")
+		}
+		sc := newTestServerConn(tc)
+
+		err := sc.auth(context.Background())
+		assertEqualf(t, ErrAuthContinue, err, "expected auth continue for %s: %v", tt.mechs, err)
+		assertEqualf(t, 0, tc.r.Len(), "wrong number of steps for %s", tt.mechs)
+	}
+}
+
+// Test that a response claiming a huge body is refused before buffering it.
+func TestMaxResponseSize(t *testing.T) {
+	for _, multi := range []bool{false, true} {
+		tc := newTestConn()
+		sc := newTestServerConn(tc)
+		h := header{
+			Magic:   magicRecv,
+			Op:      opGet,
+			BodyLen: 1 << 30,
+			Opaque:  sc.opq,
+		}
+		binary.Write(&tc.r, binary.BigEndian, h)
+
+		m := &msg{
+			header: header{
+				Op: opGet,
+			},
+			key: "foo",
+		}
+		var err error
+		if multi {
+			err = sc.sendRecvMulti([]*msg{m})
+		} else {
+			err = sc.sendRecv(m)
+		}
+		assertEqualf(t, ErrValueTooLarge, err, "expected value too large: %v", err)
+		assertTruef(t, tc.closed, "connection should have been closed")
+		assertTruef(t, sc.body == nil, "body buffer shouldn't have been allocated")
+	}
+}
+
+// Test that values streamed off the connection aren't limited by the maximum
+// response size, as they aren't buffered.
+func TestMaxResponseSizeStream(t *testing.T) {
+	val := strings.Repeat("x", 100)
+	tc := newTestConn()
+	sc := newTestServerConn(tc)
+	sc.config.MaxResponseSize = 10
+	tc.addResponse(opGet, StatusOK, sc.opq, []byte{0, 0, 0, 0}, "", val)
+
+	m := &msg{
+		header: header{
+			Op: opGet,
+		},
+		oextras: []interface{}{new(uint32)},
+		key:     "foo",
+	}
+	r, err := sc.getStream(m)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	b, err := ioutil.ReadAll(r)
+	assertEqualf(t, nil, err, "unexpected error: %v", err)
+	assertEqualf(t, val, string(b), "wrong value")
+	assertEqualf(t, nil, r.Close(), "unexpected error closing")
+	assertTruef(t, !tc.closed, "connection shouldn't have been closed")
+}